@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/slackpass/slackpass/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// cloneCmd represents the clone command
+var cloneCmd = &cobra.Command{
+	Use:   "clone [source] [name]",
+	Short: "Copy a virtual machine to a new instance",
+	Long: `Copy a virtual machine to a new, stopped instance.
+
+The clone gets its own disk, MAC address, SSH port and SSH key. Cloud-init
+runs its per-instance setup again on the first boot of the clone, giving
+it fresh SSH host keys and a new machine-id, and the key of the source is
+no longer trusted from then on. A running instance can be cloned; its
+disk is copied from a temporary snapshot.
+
+If no name is given, the clone is named <source>-cloneN.
+
+Examples:
+  slackpass clone myvm
+  slackpass clone myvm myvm-test`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var name string
+		if len(args) > 1 {
+			name = args[1]
+		}
+
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		name, err = manager.Clone(args[0], name)
+		if err != nil {
+			return fmt.Errorf("failed to clone %s: %w", args[0], err)
+		}
+
+		fmt.Printf("Cloned: %s -> %s\n", args[0], name)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cloneCmd)
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/slackpass/slackpass/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// consoleCmd represents the console command
+var consoleCmd = &cobra.Command{
+	Use:   "console <name>",
+	Short: "Attach to the serial console of a virtual machine",
+	Long: `Attach the terminal to the serial console of a running virtual
+machine. Unlike shell, this works without SSH and the network, e.g. to
+log in on a guest that did not finish booting.
+
+Press Ctrl-] to detach. Only one console can be attached to an instance
+at a time.
+
+Examples:
+  slackpass console myvm`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+		return manager.Console(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(consoleCmd)
+}
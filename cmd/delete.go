@@ -25,7 +25,10 @@ Examples:
 		purge, _ := cmd.Flags().GetBool("purge")
 		force, _ := cmd.Flags().GetBool("force")
 
-		manager := vm.NewManager()
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
 		for _, name := range args {
 			if err := manager.Delete(name, purge, force); err != nil {
 				return fmt.Errorf("failed to delete %s: %w", name, err)
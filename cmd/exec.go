@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/slackpass/slackpass/internal/ssh"
 	"github.com/slackpass/slackpass/internal/vm"
 )
 
@@ -15,26 +16,55 @@ var execCmd = &cobra.Command{
 	Long: `Execute a command on a virtual machine via SSH.
 
 The command and its arguments should be separated from the instance
-name by '--'.
+name by '--'. Arguments are passed to the command as given, stdin is
+forwarded to it and slackpass exits with the command's exit status.
 
 Examples:
   slackpass exec myvm -- ls -la
-  slackpass exec myvm -- "echo 'Hello World'"
-  slackpass exec myvm -- sudo apt update`,
+  slackpass exec myvm -- sh -c "echo 'Hello World'"
+  slackpass exec myvm -- sudo apt update
+  slackpass exec myvm --workdir /srv --env DEBUG=1 -- make test
+  slackpass exec myvm --tty -- top
+  tar c src | slackpass exec myvm -- tar x -C /tmp`,
 	Args: cobra.MinimumNArgs(1),
+	// Errors are reported by main, which also passes the remote exit
+	// status through
+	SilenceErrors: true,
+	SilenceUsage:  true,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if len(args) < 3 || args[1] != "--" {
+		if cmd.ArgsLenAtDash() != 1 || len(args) < 2 {
 			return fmt.Errorf("command must be separated by '--'")
 		}
 
+		tty, _ := cmd.Flags().GetBool("tty")
+		env, _ := cmd.Flags().GetStringArray("env")
+		workdir, _ := cmd.Flags().GetString("workdir")
+
+		for _, e := range env {
+			if key, _, ok := strings.Cut(e, "="); !ok || key == "" {
+				return fmt.Errorf("invalid environment variable %q, expected KEY=VAL", e)
+			}
+		}
+
 		name := args[0]
-		command := strings.Join(args[2:], " ")
+		opts := &ssh.ExecOptions{
+			TTY:     tty,
+			Env:     env,
+			WorkDir: workdir,
+		}
 
-		manager := vm.NewManager()
-		return manager.Exec(name, command)
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+		return manager.Exec(name, args[1:], opts)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(execCmd)
+
+	execCmd.Flags().BoolP("tty", "t", false, "Allocate a pseudo-terminal")
+	execCmd.Flags().StringArrayP("env", "e", nil, "Set an environment variable (KEY=VAL), can be repeated")
+	execCmd.Flags().StringP("workdir", "w", "", "Working directory for the command")
 }
\ No newline at end of file
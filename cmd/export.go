@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/slackpass/slackpass/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export [name]",
+	Short: "Export a virtual machine to an archive",
+	Long: `Export a virtual machine to a zstd compressed tar archive.
+
+The disk is flattened, so the archive can be imported on a host that
+does not have the base image. Snapshots are not exported.
+
+Examples:
+  slackpass export myvm
+  slackpass export myvm -o myvm-configured.tar.zst`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+		if output == "" {
+			output = args[0] + ".tar.zst"
+		}
+
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		if err := manager.Export(args[0], output); err != nil {
+			return fmt.Errorf("failed to export %s: %w", args[0], err)
+		}
+
+		fmt.Printf("Exported: %s -> %s\n", args[0], output)
+		return nil
+	},
+}
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import [file] [name]",
+	Short: "Import a virtual machine from an archive",
+	Long: `Import a virtual machine from an archive created by export.
+
+The instance keeps the name it was exported under unless a new name is
+given. It is imported stopped, with a new MAC address and SSH port.
+
+Examples:
+  slackpass import myvm.tar.zst
+  slackpass import myvm.tar.zst othervm`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var name string
+		if len(args) > 1 {
+			name = args[1]
+		}
+
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		name, err = manager.Import(args[0], name)
+		if err != nil {
+			return fmt.Errorf("failed to import %s: %w", args[0], err)
+		}
+
+		fmt.Printf("Imported: %s\n", name)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+
+	exportCmd.Flags().StringP("output", "o", "", "Archive to write (default <name>.tar.zst)")
+}
@@ -6,6 +6,7 @@ import (
 	"text/tabwriter"
 
 	"github.com/spf13/cobra"
+	"github.com/slackpass/slackpass/internal/config"
 	"github.com/slackpass/slackpass/internal/images"
 )
 
@@ -31,7 +32,12 @@ Examples:
 			filter = args[0]
 		}
 
-		imageManager := images.NewManager()
+		cfg, err := config.Load()
+		if err != nil {
+			return err
+		}
+
+		imageManager := images.NewManager(cfg)
 		availableImages, err := imageManager.Find(filter, remoteOnly)
 		if err != nil {
 			return fmt.Errorf("failed to find images: %w", err)
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/slackpass/slackpass/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// forwardCmd represents the forward command
+var forwardCmd = &cobra.Command{
+	Use:   "forward",
+	Short: "Manage port forwards of virtual machines",
+	Long: `Manage host ports forwarded to virtual machines using user-mode
+networking.
+
+Forwards are written as [address:]host:guest[/protocol]. The address
+defaults to 127.0.0.1 and the protocol to tcp. Forwards added to a
+running instance take effect immediately and are kept across restarts.
+
+Examples:
+  slackpass forward add myvm 8080:80
+  slackpass forward add myvm 0.0.0.0:5353:53/udp
+  slackpass forward list myvm
+  slackpass forward remove myvm 8080`,
+}
+
+// forwardAddCmd represents the forward add command
+var forwardAddCmd = &cobra.Command{
+	Use:   "add [name] [forward...]",
+	Short: "Forward host ports to a virtual machine",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		for _, spec := range args[1:] {
+			if err := manager.AddForward(args[0], spec); err != nil {
+				return fmt.Errorf("failed to forward %s to %s: %w", spec, args[0], err)
+			}
+			fmt.Printf("Forwarded: %s -> %s\n", spec, args[0])
+		}
+
+		return nil
+	},
+}
+
+// forwardRemoveCmd represents the forward remove command
+var forwardRemoveCmd = &cobra.Command{
+	Use:     "remove [name] [host-port...]",
+	Aliases: []string{"rm"},
+	Short:   "Remove port forwards from a virtual machine",
+	Long: `Remove the forwards of host ports, given as port[/protocol], from a
+virtual machine.
+
+Examples:
+  slackpass forward remove myvm 8080
+  slackpass forward remove myvm 5353/udp`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		for _, port := range args[1:] {
+			if err := manager.RemoveForward(args[0], port); err != nil {
+				return fmt.Errorf("failed to remove forward %s from %s: %w", port, args[0], err)
+			}
+			fmt.Printf("Removed: %s\n", port)
+		}
+
+		return nil
+	},
+}
+
+// forwardListCmd represents the forward list command
+var forwardListCmd = &cobra.Command{
+	Use:     "list [name]",
+	Aliases: []string{"ls"},
+	Short:   "List the port forwards of a virtual machine",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		forwards, err := manager.Forwards(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to list forwards of %s: %w", args[0], err)
+		}
+
+		if len(forwards) == 0 {
+			fmt.Println("No forwards found.")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "Protocol\tAddress\tHost\tGuest")
+
+		for _, forward := range forwards {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\n",
+				forward.Protocol,
+				forward.Address,
+				forward.HostPort,
+				forward.GuestPort,
+			)
+		}
+
+		return w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(forwardCmd)
+	forwardCmd.AddCommand(forwardAddCmd)
+	forwardCmd.AddCommand(forwardRemoveCmd)
+	forwardCmd.AddCommand(forwardListCmd)
+}
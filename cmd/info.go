@@ -23,7 +23,10 @@ Examples:
 	RunE: func(cmd *cobra.Command, args []string) error {
 		all, _ := cmd.Flags().GetBool("all")
 
-		manager := vm.NewManager()
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
 
 		if all {
 			instances, err := manager.List()
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/slackpass/slackpass/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// keysCmd represents the keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage the SSH keys of virtual machines",
+	Long: `Manage the SSH keys slackpass logs in to virtual machines with.
+
+Every instance has its own keypair in its instance directory. New keys
+are of the type set by ssh_key_type: ed25519 by default, or 4096-bit rsa.
+
+Examples:
+  slackpass keys rotate
+  slackpass keys rotate myvm`,
+}
+
+// keysRotateCmd represents the keys rotate command
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate [name...]",
+	Short: "Replace the SSH keys of virtual machines",
+	Long: `Replace the SSH keys of virtual machines with newly generated ones.
+
+The new public key is pushed to the instance over SSH and tried before
+the old key is removed from the guest. Only running instances can be
+rotated; without names every running instance is, and stopped ones are
+skipped.
+
+Examples:
+  slackpass keys rotate
+  slackpass keys rotate myvm other`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		names := args
+		if len(names) == 0 {
+			instances, err := manager.List()
+			if err != nil {
+				return err
+			}
+			for _, instance := range instances {
+				if instance.State != "Running" {
+					fmt.Printf("Skipped: %s is %s\n", instance.Name, instance.State)
+					continue
+				}
+				names = append(names, instance.Name)
+			}
+		}
+
+		for _, name := range names {
+			if err := manager.RotateKey(name); err != nil {
+				return fmt.Errorf("failed to rotate the key of %s: %w", name, err)
+			}
+			fmt.Printf("Rotated: %s\n", name)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysRotateCmd)
+}
@@ -29,7 +29,12 @@ Examples:
   slackpass launch debian             # Launch latest Debian with auto-generated name
   slackpass launch debian:bookworm    # Launch Debian Bookworm
   slackpass launch debian myvm        # Launch Debian with name 'myvm'
-  slackpass launch debian:bookworm myvm --cpus 2 --memory 2G --disk 20G`,
+  slackpass launch debian:bookworm myvm --cpus 2 --memory 2G --disk 20G
+  slackpass launch debian myvm --network bridge       # Attach to the configured bridge
+  slackpass launch debian myvm --network bridge=br0   # Attach to br0
+  slackpass launch debian myvm --forward 8080:80      # Forward localhost:8080 to port 80
+  slackpass launch debian myvm --mount ~/src:/src     # Share ~/src as /src
+  slackpass launch debian myvm --timeout 10m          # Allow a slow cloud-init more time`,
 	Args: cobra.MaximumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		image := "debian:bookworm" // default image
@@ -47,10 +52,15 @@ Examples:
 		memory, _ := cmd.Flags().GetString("memory")
 		disk, _ := cmd.Flags().GetString("disk")
 		cloudInit, _ := cmd.Flags().GetString("cloud-init")
+		user, _ := cmd.Flags().GetString("user")
+		networkFlag, _ := cmd.Flags().GetString("network")
+		forwards, _ := cmd.Flags().GetStringArray("forward")
+		mounts, _ := cmd.Flags().GetStringArray("mount")
+		timeout, _ := cmd.Flags().GetDuration("timeout")
 
-		// Validate image format
-		if !isValidImage(image) {
-			return fmt.Errorf("invalid image format: %s", image)
+		network, err := parseNetwork(networkFlag)
+		if err != nil {
+			return err
 		}
 
 		config := &vm.LaunchConfig{
@@ -59,10 +69,18 @@ Examples:
 			CPUs:      cpus,
 			Memory:    memory,
 			Disk:      disk,
+			User:      user,
 			CloudInit: cloudInit,
+			Network:   network,
+			Forwards:  forwards,
+			Mounts:    mounts,
+			Timeout:   timeout,
 		}
 
-		manager := vm.NewManager()
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
 		return manager.Launch(config)
 	},
 }
@@ -70,25 +88,31 @@ Examples:
 func init() {
 	rootCmd.AddCommand(launchCmd)
 
-	launchCmd.Flags().IntP("cpus", "c", 1, "Number of CPUs")
-	launchCmd.Flags().StringP("memory", "m", "1G", "Amount of memory")
-	launchCmd.Flags().StringP("disk", "d", "10G", "Disk size")
+	// Defaults come from default_cpus, default_memory and default_disk
+	launchCmd.Flags().IntP("cpus", "c", 0, "Number of CPUs (default from config, 1)")
+	launchCmd.Flags().StringP("memory", "m", "", "Amount of memory (default from config, 1G)")
+	launchCmd.Flags().StringP("disk", "d", "", "Disk size (default from config, 10G)")
 	launchCmd.Flags().String("cloud-init", "", "Path to cloud-init configuration file")
+	launchCmd.Flags().String("user", "", "Login user (default is the image's default user)")
+	launchCmd.Flags().String("network", "user", "Network mode: user, bridge or bridge=<name>")
+	launchCmd.Flags().StringArray("forward", nil, "Forward a host port to the guest, [address:]host:guest[/protocol] (repeatable)")
+	launchCmd.Flags().StringArray("mount", nil, "Share a host directory with the guest, source[:target] (repeatable)")
+	launchCmd.Flags().Duration("timeout", 0, "How long to wait for SSH and cloud-init (default from config, 5m)")
 }
 
-func isValidImage(image string) bool {
-	validDistros := []string{
-		"slackware", "debian", "fedora", "almalinux",
-		"rockylinux", "centos", "gentoo", "opensuse",
-	}
-
-	parts := strings.Split(image, ":")
-	distro := parts[0]
-
-	for _, valid := range validDistros {
-		if distro == valid {
-			return true
+// parseNetwork parses the --network flag. User-mode networking needs no
+// configuration and is returned as nil.
+func parseNetwork(value string) (*vm.NetworkConfig, error) {
+	mode, bridge, _ := strings.Cut(value, "=")
+	switch mode {
+	case "user":
+		if bridge != "" {
+			return nil, fmt.Errorf("invalid network %q", value)
 		}
+		return nil, nil
+	case "bridge":
+		return &vm.NetworkConfig{Bridge: bridge}, nil
+	default:
+		return nil, fmt.Errorf("invalid network %q, expected user, bridge or bridge=<name>", value)
 	}
-	return false
 }
\ No newline at end of file
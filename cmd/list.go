@@ -23,7 +23,10 @@ Examples:
   slackpass list
   slackpass ls`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		manager := vm.NewManager()
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
 		instances, err := manager.List()
 		if err != nil {
 			return fmt.Errorf("failed to list instances: %w", err)
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/slackpass/slackpass/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// logsCmd represents the logs command
+var logsCmd = &cobra.Command{
+	Use:   "logs <name>",
+	Short: "Print the boot log of a virtual machine",
+	Long: `Print the serial console output of the last boot of a virtual
+machine: kernel messages, the boot of the init system and cloud-init.
+
+The log is kept in console.log in the instance directory. Each start
+moves it aside to console.log.1, keeping the logs of the last three
+earlier boots.
+
+Examples:
+  slackpass logs myvm
+  slackpass logs myvm -f      # Keep printing new output`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		follow, _ := cmd.Flags().GetBool("follow")
+
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+		return manager.Logs(args[0], follow, os.Stdout)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(logsCmd)
+
+	logsCmd.Flags().BoolP("follow", "f", false, "Keep printing new output as it arrives")
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/slackpass/slackpass/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// mountCmd represents the mount command
+var mountCmd = &cobra.Command{
+	Use:   "mount [source] [name]:[path]",
+	Short: "Share a host directory with a virtual machine",
+	Long: `Share a host directory with a virtual machine.
+
+The directory is mounted in the guest at the given path, or at the same
+path as on the host. Directories are shared with virtiofs when virtiofsd
+is installed, and with 9p otherwise. A 9p share can only be added while
+the instance is stopped, a virtiofs share also while it is running if it
+was started with one. Mounts are restored whenever the instance starts.
+
+QEMU cannot save the state of a guest with shared directories, so an
+instance with mounts cannot be suspended or snapshotted while running.
+Unmount the directories first, or stop the instance to snapshot it.
+
+Examples:
+  slackpass mount ~/src myvm
+  slackpass mount ~/src myvm:/home/debian/src`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, target, _ := strings.Cut(args[1], ":")
+
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		if err := manager.Mount(args[0], name, target); err != nil {
+			return fmt.Errorf("failed to mount %s: %w", args[0], err)
+		}
+
+		fmt.Printf("Mounted: %s -> %s\n", args[0], args[1])
+		return nil
+	},
+}
+
+// umountCmd represents the umount command
+var umountCmd = &cobra.Command{
+	Use:     "umount [name][:path]...",
+	Aliases: []string{"unmount"},
+	Short:   "Stop sharing host directories with virtual machines",
+	Long: `Unmount a shared directory from a virtual machine, or all of them if
+no path is given.
+
+Examples:
+  slackpass umount myvm
+  slackpass umount myvm:/home/debian/src`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		for _, arg := range args {
+			name, target, _ := strings.Cut(arg, ":")
+			if err := manager.Umount(name, target); err != nil {
+				return fmt.Errorf("failed to unmount %s: %w", arg, err)
+			}
+			fmt.Printf("Unmounted: %s\n", arg)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(mountCmd)
+	rootCmd.AddCommand(umountCmd)
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -57,12 +58,18 @@ func initConfig() {
 		viper.SetConfigName(".slackpass")
 	}
 
-	viper.AutomaticEnv() // read in environment variables that match
+	// Read in environment variables that match, e.g. SLACKPASS_DEFAULT_CPUS
+	viper.SetEnvPrefix("slackpass")
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.AutomaticEnv()
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		if viper.GetBool("verbose") {
 			fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 		}
+	} else if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+		// A config file that exists but cannot be read is an error
+		cobra.CheckErr(fmt.Errorf("failed to read config file: %w", err))
 	}
 }
\ No newline at end of file
@@ -18,13 +18,20 @@ Examples:
   slackpass shell myvm
   slackpass shell          # Connect to the only running instance`,
 	Args: cobra.MaximumNArgs(1),
+	// Errors are reported by main, which also passes the remote exit
+	// status through
+	SilenceErrors: true,
+	SilenceUsage:  true,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var name string
 		if len(args) > 0 {
 			name = args[0]
 		}
 
-		manager := vm.NewManager()
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
 		return manager.Shell(name)
 	},
 }
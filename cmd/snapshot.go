@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/slackpass/slackpass/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// snapshotCmd represents the snapshot command
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot [name]",
+	Short: "Take a snapshot of a virtual machine",
+	Long: `Take a named snapshot of a virtual machine.
+
+A snapshot of a running instance includes its memory, so restoring it
+while the instance is running brings it back to exactly that moment.
+A snapshot of a stopped instance only holds the disk. Either way the
+CPU and memory configuration is recorded and restored with it.
+
+Examples:
+  slackpass snapshot myvm
+  slackpass snapshot myvm --name before-upgrade --comment "clean install"`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		snapshotName, _ := cmd.Flags().GetString("name")
+		comment, _ := cmd.Flags().GetString("comment")
+
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		snapshot, err := manager.Snapshot(args[0], snapshotName, comment)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot %s: %w", args[0], err)
+		}
+
+		fmt.Printf("Snapshotted: %s.%s\n", args[0], snapshot.Name)
+		return nil
+	},
+}
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore [name] [snapshot]",
+	Short: "Restore a virtual machine from a snapshot",
+	Long: `Restore a virtual machine to the state of a snapshot.
+
+Any changes made since the snapshot are lost.
+
+Examples:
+  slackpass restore myvm before-upgrade`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		if err := manager.Restore(args[0], args[1]); err != nil {
+			return fmt.Errorf("failed to restore %s: %w", args[0], err)
+		}
+
+		fmt.Printf("Restored: %s.%s\n", args[0], args[1])
+		return nil
+	},
+}
+
+// snapshotsCmd represents the snapshots command
+var snapshotsCmd = &cobra.Command{
+	Use:   "snapshots",
+	Short: "Manage virtual machine snapshots",
+}
+
+// snapshotsListCmd represents the snapshots list command
+var snapshotsListCmd = &cobra.Command{
+	Use:     "list [name]",
+	Aliases: []string{"ls"},
+	Short:   "List the snapshots of a virtual machine",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		snapshots, err := manager.Snapshots(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to list snapshots of %s: %w", args[0], err)
+		}
+
+		if len(snapshots) == 0 {
+			fmt.Println("No snapshots found.")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "Snapshot\tCreated\tLive\tCPUs\tMemory\tDisk\tComment")
+
+		for _, snapshot := range snapshots {
+			fmt.Fprintf(w, "%s\t%s\t%t\t%d\t%s\t%s\t%s\n",
+				snapshot.Name,
+				snapshot.CreatedAt.Format(time.RFC3339),
+				snapshot.Live,
+				snapshot.Metadata.CPUs,
+				snapshot.Metadata.Memory,
+				snapshot.Metadata.Disk,
+				snapshot.Comment,
+			)
+		}
+
+		return w.Flush()
+	},
+}
+
+// snapshotsDeleteCmd represents the snapshots delete command
+var snapshotsDeleteCmd = &cobra.Command{
+	Use:   "delete [name] [snapshot...]",
+	Short: "Delete snapshots of a virtual machine",
+	Args:  cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		for _, snapshot := range args[1:] {
+			if err := manager.DeleteSnapshot(args[0], snapshot); err != nil {
+				return fmt.Errorf("failed to delete %s.%s: %w", args[0], snapshot, err)
+			}
+			fmt.Printf("Deleted: %s.%s\n", args[0], snapshot)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(snapshotCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(snapshotsCmd)
+	snapshotsCmd.AddCommand(snapshotsListCmd)
+	snapshotsCmd.AddCommand(snapshotsDeleteCmd)
+
+	snapshotCmd.Flags().StringP("name", "n", "", "Snapshot name (default snapshotN)")
+	snapshotCmd.Flags().StringP("comment", "c", "", "Comment to store with the snapshot")
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/slackpass/slackpass/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// sshConfigCmd represents the ssh-config command
+var sshConfigCmd = &cobra.Command{
+	Use:   "ssh-config",
+	Short: "Write an OpenSSH config file for all virtual machines",
+	Long: `Write an OpenSSH config file with a Host slackpass-<name> entry for
+every virtual machine, giving its address, port, user, key and pinned
+host key. This lets plain ssh, VS Code Remote-SSH and Ansible reach the
+instances.
+
+The file is ~/.slackpass/ssh_config and is refreshed automatically when
+instances are launched, started and deleted, so it only has to be
+included once from ~/.ssh/config:
+
+  Include ~/.slackpass/ssh_config
+
+Examples:
+  slackpass ssh-config
+  ssh slackpass-myvm`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		path, err := manager.WriteSSHConfig()
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+
+		fmt.Printf("Wrote: %s\n", path)
+		fmt.Printf("Add \"Include %s\" to ~/.ssh/config to use it\n", path)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sshConfigCmd)
+}
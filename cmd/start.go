@@ -18,7 +18,10 @@ Examples:
   slackpass start vm1 vm2 vm3`,
 	Args: cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		manager := vm.NewManager()
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
 		for _, name := range args {
 			if err := manager.Start(name); err != nil {
 				return fmt.Errorf("failed to start %s: %w", name, err)
@@ -44,7 +47,10 @@ Examples:
 	RunE: func(cmd *cobra.Command, args []string) error {
 		force, _ := cmd.Flags().GetBool("force")
 
-		manager := vm.NewManager()
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
 		for _, name := range args {
 			if err := manager.Stop(name, force); err != nil {
 				return fmt.Errorf("failed to stop %s: %w", name, err)
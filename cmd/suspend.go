@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/slackpass/slackpass/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// suspendCmd represents the suspend command
+var suspendCmd = &cobra.Command{
+	Use:   "suspend [name...]",
+	Short: "Suspend virtual machine instances",
+	Long: `Suspend one or more running virtual machine instances.
+
+The memory and device state of each instance is saved to its instance
+directory and QEMU exits. Resume or start the instance to continue
+exactly where it left off.
+
+Examples:
+  slackpass suspend myvm
+  slackpass suspend vm1 vm2 vm3`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+		for _, name := range args {
+			if err := manager.Suspend(name); err != nil {
+				return fmt.Errorf("failed to suspend %s: %w", name, err)
+			}
+			fmt.Printf("Suspended: %s\n", name)
+		}
+
+		return nil
+	},
+}
+
+// resumeCmd represents the resume command
+var resumeCmd = &cobra.Command{
+	Use:   "resume [name...]",
+	Short: "Resume suspended virtual machine instances",
+	Long: `Resume one or more suspended virtual machine instances.
+
+Examples:
+  slackpass resume myvm
+  slackpass resume vm1 vm2 vm3`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+		for _, name := range args {
+			if err := manager.Resume(name); err != nil {
+				return fmt.Errorf("failed to resume %s: %w", name, err)
+			}
+			fmt.Printf("Resumed: %s\n", name)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(suspendCmd)
+	rootCmd.AddCommand(resumeCmd)
+}
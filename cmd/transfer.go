@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/slackpass/slackpass/internal/vm"
+	"github.com/spf13/cobra"
+)
+
+// transferCmd represents the transfer command
+var transferCmd = &cobra.Command{
+	Use:     "transfer [source...] [destination]",
+	Aliases: []string{"copy-files"},
+	Short:   "Copy files between the host and a virtual machine",
+	Long: `Copy files between the host and a virtual machine.
+
+Paths on a virtual machine are written as name:path, relative paths
+being relative to the home directory of the login user. Either all
+sources or the destination must be on a virtual machine. Use - as the
+only source to copy stdin, or as the destination to copy to stdout.
+Permissions and modification times are preserved. Symbolic links
+inside copied directories are recreated as links, sockets, pipes and
+devices are skipped.
+
+Examples:
+  slackpass transfer notes.txt myvm:
+  slackpass transfer -r ./project myvm:/srv/project
+  slackpass transfer myvm:/var/log/syslog .
+  echo hello | slackpass transfer - myvm:hello.txt
+  slackpass transfer myvm:/etc/os-release -`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		recursive, _ := cmd.Flags().GetBool("recursive")
+
+		manager, err := vm.NewManager()
+		if err != nil {
+			return err
+		}
+
+		sources, target := args[:len(args)-1], args[len(args)-1]
+		if err := manager.Transfer(sources, target, recursive); err != nil {
+			return fmt.Errorf("failed to transfer files: %w", err)
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(transferCmd)
+
+	transferCmd.Flags().BoolP("recursive", "r", false, "Copy directories recursively")
+}
@@ -1,9 +1,18 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
 )
 
 // Config holds the application configuration
@@ -15,15 +24,18 @@ type Config struct {
 	KeysDir      string `yaml:"keys_dir"`
 
 	// KVM/QEMU settings
-	QEMUBinary    string `yaml:"qemu_binary"`
-	QEMUImgBinary string `yaml:"qemu_img_binary"`
-	BridgeName    string `yaml:"bridge_name"`
+	QEMUBinary      string `yaml:"qemu_binary"`
+	QEMUImgBinary   string `yaml:"qemu_img_binary"`
+	VirtiofsdBinary string `yaml:"virtiofsd_binary"` // Empty to share directories over 9p
+	BridgeName      string `yaml:"bridge_name"`
+	BridgeLeases    string `yaml:"bridge_leases"` // dnsmasq leases file of the bridge
 
 	// SSH settings
-	SSHKeyPath   string `yaml:"ssh_key_path"`
-	SSHUser      string `yaml:"ssh_user"`
-	SSHPort      int    `yaml:"ssh_port"`
-	SSHTimeout   int    `yaml:"ssh_timeout"`
+	SSHKeyPath string `yaml:"ssh_key_path"`
+	SSHKeyType string `yaml:"ssh_key_type"` // ed25519 or rsa, for new keys
+	SSHUser    string `yaml:"ssh_user"`     // Overrides the image's default user
+	SSHPort    int    `yaml:"ssh_port"`
+	SSHTimeout int    `yaml:"ssh_timeout"` // Seconds to wait for an instance to be ready
 
 	// Default VM settings
 	DefaultCPUs   int    `yaml:"default_cpus"`
@@ -34,14 +46,107 @@ type Config struct {
 	ImageRepositories map[string]string `yaml:"image_repositories"`
 }
 
-// Load loads the configuration from file or returns defaults
-func Load() *Config {
-	cfg := getDefaults()
+// derivedKeys are settings whose default depends on other settings, so
+// they are filled in after the user's values have been applied
+var derivedKeys = map[string]bool{
+	"instances_dir": true,
+	"images_dir":    true,
+	"keys_dir":      true,
+	"ssh_key_path":  true,
+	"bridge_leases": true,
+}
 
-	// TODO: Load from config file if exists
-	// For now, just return defaults
+// Load builds the configuration from the defaults, overridden by whatever
+// viper has collected from the config file, SLACKPASS_* environment
+// variables and bound flags
+func Load() (*Config, error) {
+	registerDefaults(getDefaults())
 
-	return cfg
+	cfg := &Config{}
+	err := viper.Unmarshal(cfg, func(dc *mapstructure.DecoderConfig) {
+		dc.TagName = "yaml"
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %w", err)
+	}
+
+	cfg.DataDir = expandHome(cfg.DataDir)
+	if cfg.InstancesDir == "" {
+		cfg.InstancesDir = filepath.Join(cfg.DataDir, "instances")
+	}
+	if cfg.ImagesDir == "" {
+		cfg.ImagesDir = filepath.Join(cfg.DataDir, "images")
+	}
+	if cfg.KeysDir == "" {
+		cfg.KeysDir = filepath.Join(cfg.DataDir, "keys")
+	}
+	if cfg.SSHKeyPath == "" {
+		cfg.SSHKeyPath = filepath.Join(cfg.KeysDir, "slackpass_rsa")
+	}
+	if cfg.BridgeLeases == "" {
+		cfg.BridgeLeases = defaultBridgeLeases(cfg.BridgeName)
+	}
+	cfg.InstancesDir = expandHome(cfg.InstancesDir)
+	cfg.ImagesDir = expandHome(cfg.ImagesDir)
+	cfg.KeysDir = expandHome(cfg.KeysDir)
+	cfg.SSHKeyPath = expandHome(cfg.SSHKeyPath)
+
+	// Ensure data directories exist
+	for _, dir := range cfg.directories() {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Validate checks that the configuration can be used to run instances:
+// the QEMU binaries exist, sizes parse and the data directories are
+// writable
+func (c *Config) Validate() error {
+	var errs []error
+
+	for _, binary := range []string{c.QEMUBinary, c.QEMUImgBinary} {
+		if _, err := exec.LookPath(binary); err != nil {
+			errs = append(errs, fmt.Errorf("%s not found: %w", binary, err))
+		}
+	}
+
+	if c.DefaultCPUs < 1 {
+		errs = append(errs, fmt.Errorf("default_cpus must be at least 1, got %d", c.DefaultCPUs))
+	}
+	if _, err := ParseSize(c.DefaultMemory); err != nil {
+		errs = append(errs, fmt.Errorf("default_memory: %w", err))
+	}
+	if _, err := ParseSize(c.DefaultDisk); err != nil {
+		errs = append(errs, fmt.Errorf("default_disk: %w", err))
+	}
+	if c.SSHPort < 1 || c.SSHPort > 65535 {
+		errs = append(errs, fmt.Errorf("ssh_port must be between 1 and 65535, got %d", c.SSHPort))
+	}
+	if c.SSHKeyType != "ed25519" && c.SSHKeyType != "rsa" {
+		errs = append(errs, fmt.Errorf("ssh_key_type must be ed25519 or rsa, got %q", c.SSHKeyType))
+	}
+	if c.SSHTimeout < 1 {
+		errs = append(errs, fmt.Errorf("ssh_timeout must be positive, got %d", c.SSHTimeout))
+	}
+
+	for _, dir := range c.directories() {
+		if err := checkWritable(dir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return nil
+}
+
+// directories returns the data directories slackpass writes to
+func (c *Config) directories() []string {
+	return []string{c.DataDir, c.InstancesDir, c.ImagesDir, c.KeysDir}
 }
 
 // getDefaults returns the default configuration
@@ -49,12 +154,6 @@ func getDefaults() *Config {
 	homeDir, _ := os.UserHomeDir()
 	dataDir := filepath.Join(homeDir, ".slackpass")
 
-	// Ensure data directory exists
-	os.MkdirAll(dataDir, 0755)
-	os.MkdirAll(filepath.Join(dataDir, "instances"), 0755)
-	os.MkdirAll(filepath.Join(dataDir, "images"), 0755)
-	os.MkdirAll(filepath.Join(dataDir, "keys"), 0755)
-
 	cfg := &Config{
 		// Directories
 		DataDir:      dataDir,
@@ -63,15 +162,18 @@ func getDefaults() *Config {
 		KeysDir:      filepath.Join(dataDir, "keys"),
 
 		// KVM/QEMU settings
-		QEMUBinary:    getQEMUBinary(),
-		QEMUImgBinary: getQEMUImgBinary(),
-		BridgeName:    "slackpass0",
+		QEMUBinary:      getQEMUBinary(),
+		QEMUImgBinary:   getQEMUImgBinary(),
+		VirtiofsdBinary: getVirtiofsdBinary(),
+		BridgeName:      "slackpass0",
+		BridgeLeases:    defaultBridgeLeases("slackpass0"),
 
 		// SSH settings
 		SSHKeyPath: filepath.Join(dataDir, "keys", "slackpass_rsa"),
-		SSHUser:    "ubuntu", // Default cloud user
+		SSHKeyType: "ed25519",
+		SSHUser:    "", // Use the default user of each image
 		SSHPort:    22,
-		SSHTimeout: 30,
+		SSHTimeout: 300, // Enough for cloud-init to install a few packages
 
 		// Default VM settings
 		DefaultCPUs:   1,
@@ -85,6 +187,53 @@ func getDefaults() *Config {
 	return cfg
 }
 
+// defaultBridgeLeases returns where a dnsmasq serving the bridge keeps its
+// leases when started with --dhcp-leasefile named after the bridge
+func defaultBridgeLeases(bridge string) string {
+	return filepath.Join("/var/lib/misc", "dnsmasq."+bridge+".leases")
+}
+
+// registerDefaults makes viper aware of every setting so that environment
+// variables are picked up for all of them. Derived settings only get an
+// environment binding and keep no default of their own.
+func registerDefaults(defaults *Config) {
+	v := reflect.ValueOf(defaults).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("yaml")
+		if key == "" {
+			continue
+		}
+		if derivedKeys[key] {
+			viper.BindEnv(key)
+			continue
+		}
+		viper.SetDefault(key, v.Field(i).Interface())
+	}
+}
+
+// checkWritable verifies that files can be created in dir
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".slackpass-write-test-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// expandHome expands a leading ~ to the user's home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(homeDir, strings.TrimPrefix(path, "~"))
+}
+
 // getQEMUBinary returns the path to the QEMU binary
 func getQEMUBinary() string {
 	switch runtime.GOOS {
@@ -126,6 +275,25 @@ func getQEMUImgBinary() string {
 	}
 }
 
+// getVirtiofsdBinary returns the path to virtiofsd, or an empty string if
+// it is not installed
+func getVirtiofsdBinary() string {
+	paths := []string{
+		"/usr/libexec/virtiofsd",
+		"/usr/lib/qemu/virtiofsd",
+		"/usr/lib/virtiofsd",
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	if path, err := exec.LookPath("virtiofsd"); err == nil {
+		return path
+	}
+	return ""
+}
+
 // getDefaultRepositories returns the default image repositories
 func getDefaultRepositories() map[string]string {
 	return map[string]string{
@@ -138,4 +306,51 @@ func getDefaultRepositories() map[string]string {
 		"gentoo":     "https://bouncer.gentoo.org/fetch/root/all/releases",
 		"slackware":  "https://mirrors.slackware.com/slackware",
 	}
-}
\ No newline at end of file
+}
+
+// ParseSize parses a size such as "512M", "10G" or "1T" into bytes.
+// A plain number is taken to be a byte count.
+func ParseSize(size string) (int64, error) {
+	s := strings.TrimSpace(strings.ToUpper(size))
+	s = strings.TrimSuffix(s, "B")
+	s = strings.TrimSuffix(s, "I")
+	if s == "" {
+		return 0, fmt.Errorf("invalid size: %q", size)
+	}
+
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		multiplier = 1 << 10
+	case 'M':
+		multiplier = 1 << 20
+	case 'G':
+		multiplier = 1 << 30
+	case 'T':
+		multiplier = 1 << 40
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size: %q", size)
+	}
+
+	return int64(value * float64(multiplier)), nil
+}
+
+// FormatSize formats a byte count using binary units, e.g. "1.5 GiB"
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
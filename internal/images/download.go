@@ -0,0 +1,309 @@
+package images
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/slackpass/slackpass/internal/config"
+)
+
+// ProgressFunc is called periodically while an image is being downloaded
+type ProgressFunc func(progress *DownloadProgress)
+
+// progressInterval is how often a ProgressFunc is called
+const progressInterval = 250 * time.Millisecond
+
+const (
+	// connectTimeout bounds connecting to a mirror and waiting for the
+	// response headers
+	connectTimeout = 30 * time.Second
+
+	// stallTimeout is how long a download may go without receiving data
+	stallTimeout = 60 * time.Second
+)
+
+// errStalled is returned when a mirror stops sending data
+var errStalled = errors.New("no data received for " + stallTimeout.String())
+
+// bsdChecksumLine matches "SHA256 (file) = hash" lines used by Fedora,
+// AlmaLinux and Rocky Linux CHECKSUM files
+var bsdChecksumLine = regexp.MustCompile(`^(SHA256|SHA512) \((.+)\) = ([0-9a-fA-F]+)$`)
+
+// download fetches an image into the cache, resuming a previous partial
+// download if there is one, and verifies it against its checksum
+func (m *Manager) download(info *ImageInfo, progress ProgressFunc) (string, error) {
+	if !isDiskImage(info.URL) {
+		return "", fmt.Errorf("no cloud disk image is available for %s:%s", info.Distribution, info.Version)
+	}
+
+	localPath := m.imagePath(info)
+	if _, err := os.Stat(localPath); err == nil {
+		return localPath, nil
+	}
+
+	expected, err := m.expectedChecksum(info)
+	if err != nil {
+		return "", fmt.Errorf("failed to get checksum: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return "", fmt.Errorf("failed to create image directory: %w", err)
+	}
+
+	partPath := localPath + ".part"
+	if err := m.fetch(info, partPath, progress); err != nil {
+		return "", err
+	}
+
+	if err := verifyChecksum(partPath, expected); err != nil {
+		os.Remove(partPath)
+		return "", err
+	}
+
+	if err := os.Rename(partPath, localPath); err != nil {
+		return "", fmt.Errorf("failed to store image: %w", err)
+	}
+
+	return localPath, nil
+}
+
+// fetch downloads info.URL into partPath, continuing from the end of the
+// file with a Range request when it already exists
+func (m *Manager) fetch(info *ImageInfo, partPath string, progress ProgressFunc) error {
+	var offset int64
+	if st, err := os.Stat(partPath); err == nil {
+		offset = st.Size()
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, info.URL, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", info.URL, err)
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// The server ignored the range, start over
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is already complete
+		return nil
+	default:
+		return fmt.Errorf("failed to download %s: %s", info.URL, resp.Status)
+	}
+
+	out, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+
+	tracker := &progressTracker{
+		progress: &DownloadProgress{
+			ImageName:  info.Distribution + ":" + info.Version,
+			TotalBytes: total,
+			Downloaded: offset,
+		},
+		callback: progress,
+		offset:   offset,
+		started:  time.Now(),
+	}
+
+	// A mirror that stops sending would otherwise block the read forever
+	stall := time.AfterFunc(stallTimeout, func() { cancel(errStalled) })
+	defer stall.Stop()
+	body := &stallReader{r: resp.Body, timer: stall}
+
+	if _, err := io.Copy(out, io.TeeReader(body, tracker)); err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			err = cause
+		}
+		return fmt.Errorf("download interrupted: %w", err)
+	}
+	tracker.report(true)
+
+	return out.Close()
+}
+
+// expectedChecksum returns the checksum an image must match, either from
+// the image definition or from the distro's published checksum file
+func (m *Manager) expectedChecksum(info *ImageInfo) (string, error) {
+	if info.Checksum != "" {
+		return strings.ToLower(info.Checksum), nil
+	}
+	if info.ChecksumURL == "" {
+		return "", fmt.Errorf("no checksum published for %s:%s", info.Distribution, info.Version)
+	}
+
+	resp, err := m.httpClient.Get(info.ChecksumURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch %s: %s", info.ChecksumURL, resp.Status)
+	}
+
+	return findChecksum(resp.Body, path.Base(info.URL))
+}
+
+// findChecksum looks up the checksum of fileName in a SHA256SUMS style
+// ("hash  file") or CHECKSUM style ("SHA256 (file) = hash") listing
+func findChecksum(r io.Reader, fileName string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if match := bsdChecksumLine.FindStringSubmatch(line); match != nil {
+			if match[2] == fileName {
+				return strings.ToLower(match[3]), nil
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == fileName {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("%s is not listed in the checksum file", fileName)
+}
+
+// verifyChecksum compares a file against a hex encoded SHA256 or SHA512
+// checksum, choosing the algorithm from the checksum length
+func verifyChecksum(filePath, expected string) error {
+	var h hash.Hash
+	switch len(expected) {
+	case sha256.Size * 2:
+		h = sha256.New()
+	case sha512.Size * 2:
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported checksum: %s", expected)
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", filepath.Base(filePath), expected, actual)
+	}
+
+	return nil
+}
+
+// isDiskImage reports whether a URL points at a bootable disk image
+// rather than a tarball or a directory listing
+func isDiskImage(url string) bool {
+	for _, ext := range []string{".qcow2", ".img", ".raw"} {
+		if strings.HasSuffix(url, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// stallReader restarts a timer every time data arrives
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(stallTimeout)
+	}
+	return n, err
+}
+
+// progressTracker counts downloaded bytes and fills in DownloadProgress
+type progressTracker struct {
+	progress   *DownloadProgress
+	callback   ProgressFunc
+	offset     int64
+	started    time.Time
+	lastReport time.Time
+}
+
+func (t *progressTracker) Write(p []byte) (int, error) {
+	t.progress.Downloaded += int64(len(p))
+	t.report(false)
+	return len(p), nil
+}
+
+func (t *progressTracker) report(final bool) {
+	if t.callback == nil {
+		return
+	}
+
+	now := time.Now()
+	if !final && now.Sub(t.lastReport) < progressInterval {
+		return
+	}
+	t.lastReport = now
+
+	p := t.progress
+	elapsed := now.Sub(t.started).Seconds()
+	speed := 0.0
+	if elapsed > 0 {
+		speed = float64(p.Downloaded-t.offset) / elapsed
+	}
+	p.Speed = config.FormatSize(int64(speed)) + "/s"
+
+	if p.TotalBytes > 0 {
+		p.Percentage = float64(p.Downloaded) / float64(p.TotalBytes) * 100
+		if speed > 0 {
+			remaining := time.Duration(float64(p.TotalBytes-p.Downloaded) / speed * float64(time.Second))
+			p.TimeRemaining = remaining.Round(time.Second).String()
+		}
+	}
+
+	t.callback(p)
+}
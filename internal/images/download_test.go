@@ -0,0 +1,211 @@
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/slackpass/slackpass/internal/config"
+)
+
+var testImage = []byte("not really a disk image, but close enough for a checksum")
+
+func testChecksum() string {
+	sum := sha256.Sum256(testImage)
+	return hex.EncodeToString(sum[:])
+}
+
+// newTestManager returns a manager that downloads from srv into a
+// temporary images directory, along with the image to download
+func newTestManager(t *testing.T, srv *httptest.Server) (*Manager, *ImageInfo) {
+	t.Helper()
+	m := &Manager{
+		config:     &config.Config{ImagesDir: t.TempDir()},
+		httpClient: srv.Client(),
+	}
+	info := &ImageInfo{
+		Distribution: "test",
+		Version:      "1",
+		URL:          srv.URL + "/test.qcow2",
+		Checksum:     testChecksum(),
+	}
+	return m, info
+}
+
+// writePart leaves a partial download of the first n bytes of the image
+func writePart(t *testing.T, m *Manager, info *ImageInfo, n int) string {
+	t.Helper()
+	partPath := m.imagePath(info) + ".part"
+	if err := os.MkdirAll(filepath.Dir(partPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partPath, testImage[:n], 0644); err != nil {
+		t.Fatal(err)
+	}
+	return partPath
+}
+
+func checkDownloaded(t *testing.T, m *Manager, info *ImageInfo, localPath string) {
+	t.Helper()
+	if localPath != m.imagePath(info) {
+		t.Errorf("got path %s, want %s", localPath, m.imagePath(info))
+	}
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(testImage) {
+		t.Errorf("got image %q, want %q", data, testImage)
+	}
+	if _, err := os.Stat(localPath + ".part"); !os.IsNotExist(err) {
+		t.Errorf("partial download was left behind: %v", err)
+	}
+}
+
+func TestDownloadResumesPartialFile(t *testing.T) {
+	const offset = 10
+	var gotRange string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRange = r.Header.Get("Range")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(testImage)-1, len(testImage)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(testImage[offset:])
+	}))
+	defer srv.Close()
+
+	m, info := newTestManager(t, srv)
+	writePart(t, m, info, offset)
+
+	localPath, err := m.download(info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("bytes=%d-", offset); gotRange != want {
+		t.Errorf("got Range %q, want %q", gotRange, want)
+	}
+	checkDownloaded(t, m, info, localPath)
+}
+
+func TestDownloadRestartsWhenRangeIgnored(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testImage)
+	}))
+	defer srv.Close()
+
+	m, info := newTestManager(t, srv)
+	writePart(t, m, info, 10)
+
+	localPath, err := m.download(info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, m, info, localPath)
+}
+
+func TestDownloadCompletePartialFile(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(testImage)))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	}))
+	defer srv.Close()
+
+	m, info := newTestManager(t, srv)
+	writePart(t, m, info, len(testImage))
+
+	localPath, err := m.download(info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, m, info, localPath)
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("corrupted"))
+	}))
+	defer srv.Close()
+
+	m, info := newTestManager(t, srv)
+
+	_, err := m.download(info, nil)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("got error %v, want a checksum mismatch", err)
+	}
+	if _, err := os.Stat(m.imagePath(info) + ".part"); !os.IsNotExist(err) {
+		t.Errorf("partial download was not removed: %v", err)
+	}
+	if _, err := os.Stat(m.imagePath(info)); !os.IsNotExist(err) {
+		t.Errorf("corrupted image was stored: %v", err)
+	}
+}
+
+func TestDownloadChecksumFile(t *testing.T) {
+	sums := "0000000000000000000000000000000000000000000000000000000000000000  other.qcow2\n" +
+		strings.ToUpper(testChecksum()) + " *test.qcow2\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/SHA256SUMS" {
+			w.Write([]byte(sums))
+			return
+		}
+		w.Write(testImage)
+	}))
+	defer srv.Close()
+
+	m, info := newTestManager(t, srv)
+	info.Checksum = ""
+	info.ChecksumURL = srv.URL + "/SHA256SUMS"
+
+	localPath, err := m.download(info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDownloaded(t, m, info, localPath)
+}
+
+func TestFindChecksum(t *testing.T) {
+	tests := []struct {
+		name    string
+		listing string
+		want    string
+	}{
+		{
+			name:    "gnu",
+			listing: "aaaa  other.img\nBBBB  disk.qcow2\n",
+			want:    "bbbb",
+		},
+		{
+			name:    "gnu binary",
+			listing: "cccc *disk.qcow2\n",
+			want:    "cccc",
+		},
+		{
+			name: "bsd",
+			listing: "# disk.qcow2: 1234 bytes\n" +
+				"SHA256 (other.qcow2) = aaaa\n" +
+				"SHA256 (disk.qcow2) = DDDD\n",
+			want: "dddd",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := findChecksum(strings.NewReader(tt.listing), "disk.qcow2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := findChecksum(strings.NewReader("aaaa  other.img\n"), "disk.qcow2"); err == nil {
+		t.Error("expected an error for an unlisted file")
+	}
+}
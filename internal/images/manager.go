@@ -2,18 +2,49 @@ package images
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/slackpass/slackpass/internal/config"
 )
 
 // Manager handles image operations
 type Manager struct {
-	images map[string][]*ImageInfo
+	config     *config.Config
+	images     map[string][]*ImageInfo
+	httpClient *http.Client
 }
 
 // NewManager creates a new image manager
-func NewManager() *Manager {
+func NewManager(cfg *config.Config) *Manager {
 	return &Manager{
-		images: getBuiltinImages(),
+		config:     cfg,
+		images:     getBuiltinImages(),
+		httpClient: newHTTPClient(),
+	}
+}
+
+// newHTTPClient returns the client images are downloaded with. It has no
+// overall timeout, since images are large, but gives up on mirrors that
+// do not connect or answer; stalls during the transfer are caught by
+// fetch.
+func newHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   connectTimeout,
+			ResponseHeaderTimeout: connectTimeout,
+		},
 	}
 }
 
@@ -28,6 +59,14 @@ func (m *Manager) Find(filter string, remoteOnly bool) ([]*ImageInfo, error) {
 		}
 
 		for _, img := range versions {
+			localPath := m.imagePath(img)
+			if _, err := os.Stat(localPath); err == nil {
+				img.Cached = true
+				img.LocalPath = localPath
+				if remoteOnly {
+					continue
+				}
+			}
 			result = append(result, img)
 		}
 	}
@@ -35,16 +74,77 @@ func (m *Manager) Find(filter string, remoteOnly bool) ([]*ImageInfo, error) {
 	return result, nil
 }
 
-// Download downloads an image to local cache
-func (m *Manager) Download(image string) (string, error) {
-	// TODO: Implement image downloading
-	return "", fmt.Errorf("image downloading not implemented yet")
+// Download downloads an image to local cache and returns its path. The
+// progress callback may be nil.
+func (m *Manager) Download(image string, progress ProgressFunc) (string, error) {
+	info, err := m.Resolve(image)
+	if err != nil {
+		return "", err
+	}
+
+	localPath, err := m.download(info, progress)
+	if err != nil {
+		return "", err
+	}
+
+	info.Cached = true
+	info.LocalPath = localPath
+	return localPath, nil
 }
 
 // GetImagePath returns the local path to an image
 func (m *Manager) GetImagePath(image string) (string, error) {
-	// TODO: Implement image path resolution
-	return "", fmt.Errorf("image path resolution not implemented yet")
+	info, err := m.Resolve(image)
+	if err != nil {
+		return "", err
+	}
+
+	localPath := m.imagePath(info)
+	if _, err := os.Stat(localPath); err != nil {
+		return "", fmt.Errorf("image %s is not cached", image)
+	}
+
+	return localPath, nil
+}
+
+// Resolve finds the image definition for a name such as "debian",
+// "debian:12" or "fedora:latest". The version may be the image version
+// or one of its aliases and defaults to "latest".
+func (m *Manager) Resolve(image string) (*ImageInfo, error) {
+	distro, version, _ := strings.Cut(image, ":")
+	if version == "" {
+		version = "latest"
+	}
+
+	versions, ok := m.images[distro]
+	if !ok {
+		return nil, fmt.Errorf("unknown distribution: %s", distro)
+	}
+
+	var known []string
+	for _, img := range versions {
+		if img.Version == version || hasAlias(img, version) {
+			return img, nil
+		}
+		known = append(known, img.Version)
+	}
+
+	return nil, fmt.Errorf("unknown version %q of %s (available: %s)", version, distro, strings.Join(known, ", "))
+}
+
+// hasAlias reports whether name is one of the image's aliases
+func hasAlias(img *ImageInfo, name string) bool {
+	for _, alias := range strings.Split(img.Aliases, ",") {
+		if strings.TrimSpace(alias) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// imagePath returns where an image is stored in the cache
+func (m *Manager) imagePath(info *ImageInfo) string {
+	return filepath.Join(m.config.ImagesDir, info.Distribution, info.Version, path.Base(info.URL))
 }
 
 // getBuiltinImages returns the list of supported images
@@ -57,7 +157,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "12, latest",
 				Description:  "Debian 12 (Bookworm)",
 				Architecture: "amd64",
+				DefaultUser:  "debian",
 				URL:          "https://cloud.debian.org/images/cloud/bookworm/latest/debian-12-generic-amd64.qcow2",
+				ChecksumURL:  "https://cloud.debian.org/images/cloud/bookworm/latest/SHA512SUMS",
 			},
 			{
 				Distribution: "debian",
@@ -65,7 +167,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "11",
 				Description:  "Debian 11 (Bullseye)",
 				Architecture: "amd64",
+				DefaultUser:  "debian",
 				URL:          "https://cloud.debian.org/images/cloud/bullseye/latest/debian-11-generic-amd64.qcow2",
+				ChecksumURL:  "https://cloud.debian.org/images/cloud/bullseye/latest/SHA512SUMS",
 			},
 		},
 		"fedora": {
@@ -75,7 +179,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "latest",
 				Description:  "Fedora 39",
 				Architecture: "amd64",
+				DefaultUser:  "fedora",
 				URL:          "https://download.fedoraproject.org/pub/fedora/linux/releases/39/Cloud/x86_64/images/Fedora-Cloud-Base-39-1.5.x86_64.qcow2",
+				ChecksumURL:  "https://download.fedoraproject.org/pub/fedora/linux/releases/39/Cloud/x86_64/images/Fedora-Cloud-39-1.5-x86_64-CHECKSUM",
 			},
 			{
 				Distribution: "fedora",
@@ -83,7 +189,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "",
 				Description:  "Fedora 38",
 				Architecture: "amd64",
+				DefaultUser:  "fedora",
 				URL:          "https://download.fedoraproject.org/pub/fedora/linux/releases/38/Cloud/x86_64/images/Fedora-Cloud-Base-38-1.6.x86_64.qcow2",
+				ChecksumURL:  "https://download.fedoraproject.org/pub/fedora/linux/releases/38/Cloud/x86_64/images/Fedora-Cloud-38-1.6-x86_64-CHECKSUM",
 			},
 		},
 		"almalinux": {
@@ -93,7 +201,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "latest",
 				Description:  "AlmaLinux 9",
 				Architecture: "amd64",
+				DefaultUser:  "almalinux",
 				URL:          "https://repo.almalinux.org/almalinux/9/cloud/x86_64/images/AlmaLinux-9-GenericCloud-latest.x86_64.qcow2",
+				ChecksumURL:  "https://repo.almalinux.org/almalinux/9/cloud/x86_64/images/CHECKSUM",
 			},
 			{
 				Distribution: "almalinux",
@@ -101,7 +211,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "",
 				Description:  "AlmaLinux 8",
 				Architecture: "amd64",
+				DefaultUser:  "almalinux",
 				URL:          "https://repo.almalinux.org/almalinux/8/cloud/x86_64/images/AlmaLinux-8-GenericCloud-latest.x86_64.qcow2",
+				ChecksumURL:  "https://repo.almalinux.org/almalinux/8/cloud/x86_64/images/CHECKSUM",
 			},
 		},
 		"rockylinux": {
@@ -111,7 +223,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "latest",
 				Description:  "Rocky Linux 9",
 				Architecture: "amd64",
+				DefaultUser:  "rocky",
 				URL:          "https://download.rockylinux.org/pub/rocky/9/images/x86_64/Rocky-9-GenericCloud-Base.latest.x86_64.qcow2",
+				ChecksumURL:  "https://download.rockylinux.org/pub/rocky/9/images/x86_64/CHECKSUM",
 			},
 			{
 				Distribution: "rockylinux",
@@ -119,7 +233,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "",
 				Description:  "Rocky Linux 8",
 				Architecture: "amd64",
+				DefaultUser:  "rocky",
 				URL:          "https://download.rockylinux.org/pub/rocky/8/images/x86_64/Rocky-8-GenericCloud-Base.latest.x86_64.qcow2",
+				ChecksumURL:  "https://download.rockylinux.org/pub/rocky/8/images/x86_64/CHECKSUM",
 			},
 		},
 		"centos": {
@@ -129,7 +245,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "latest",
 				Description:  "CentOS Stream 9",
 				Architecture: "amd64",
+				DefaultUser:  "cloud-user",
 				URL:          "https://cloud.centos.org/centos/9-stream/x86_64/images/CentOS-Stream-GenericCloud-9-latest.x86_64.qcow2",
+				ChecksumURL:  "https://cloud.centos.org/centos/9-stream/x86_64/images/CentOS-Stream-GenericCloud-9-latest.x86_64.qcow2.SHA256SUM",
 			},
 			{
 				Distribution: "centos",
@@ -137,7 +255,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "",
 				Description:  "CentOS Stream 8",
 				Architecture: "amd64",
+				DefaultUser:  "centos",
 				URL:          "https://cloud.centos.org/centos/8-stream/x86_64/images/CentOS-Stream-GenericCloud-8-latest.x86_64.qcow2",
+				ChecksumURL:  "https://cloud.centos.org/centos/8-stream/x86_64/images/CentOS-Stream-GenericCloud-8-latest.x86_64.qcow2.SHA256SUM",
 			},
 		},
 		"opensuse": {
@@ -147,7 +267,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "latest",
 				Description:  "openSUSE Tumbleweed",
 				Architecture: "amd64",
+				DefaultUser:  "opensuse",
 				URL:          "https://download.opensuse.org/repositories/Cloud:/Images:/Leap_15.5/images/openSUSE-Leap-15.5-OpenStack.x86_64.qcow2",
+				ChecksumURL:  "https://download.opensuse.org/repositories/Cloud:/Images:/Leap_15.5/images/openSUSE-Leap-15.5-OpenStack.x86_64.qcow2.sha256",
 			},
 			{
 				Distribution: "opensuse",
@@ -155,7 +277,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "15.5",
 				Description:  "openSUSE Leap 15.5",
 				Architecture: "amd64",
+				DefaultUser:  "opensuse",
 				URL:          "https://download.opensuse.org/repositories/Cloud:/Images:/Leap_15.5/images/openSUSE-Leap-15.5-OpenStack.x86_64.qcow2",
+				ChecksumURL:  "https://download.opensuse.org/repositories/Cloud:/Images:/Leap_15.5/images/openSUSE-Leap-15.5-OpenStack.x86_64.qcow2.sha256",
 			},
 		},
 		"gentoo": {
@@ -165,6 +289,7 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "current",
 				Description:  "Gentoo Linux (Latest)",
 				Architecture: "amd64",
+				DefaultUser:  "gentoo",
 				URL:          "https://bouncer.gentoo.org/fetch/root/all/releases/amd64/autobuilds/current-stage3-amd64-openrc/stage3-amd64-openrc-latest.tar.xz",
 			},
 		},
@@ -175,6 +300,7 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "latest, current",
 				Description:  "Slackware Linux 15.0",
 				Architecture: "amd64",
+				DefaultUser:  "slackware",
 				URL:          "https://mirrors.slackware.com/slackware/slackware64-15.0/",
 			},
 			{
@@ -183,8 +309,9 @@ func getBuiltinImages() map[string][]*ImageInfo {
 				Aliases:      "",
 				Description:  "Slackware Linux 14.2",
 				Architecture: "amd64",
+				DefaultUser:  "slackware",
 				URL:          "https://mirrors.slackware.com/slackware/slackware64-14.2/",
 			},
 		},
 	}
-}
\ No newline at end of file
+}
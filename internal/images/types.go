@@ -4,11 +4,13 @@ package images
 type ImageInfo struct {
 	Distribution string `json:"distribution"` // e.g., "debian"
 	Version      string `json:"version"`      // e.g., "bookworm"
-	Aliases      string `json:"aliases"`     // e.g., "12, latest"
+	Aliases      string `json:"aliases"`      // e.g., "12, latest"
 	Description  string `json:"description"`  // Human readable description
 	Architecture string `json:"architecture"` // e.g., "amd64"
+	DefaultUser  string `json:"default_user"` // Login user of the cloud image
 	URL          string `json:"url"`          // Download URL
 	Checksum     string `json:"checksum"`     // SHA256 checksum
+	ChecksumURL  string `json:"checksum_url"` // Published SHA256SUMS/CHECKSUM file
 	Size         int64  `json:"size"`         // File size in bytes
 	Cached       bool   `json:"cached"`       // Whether image is cached locally
 	LocalPath    string `json:"local_path"`   // Local file path if cached
@@ -24,10 +26,10 @@ type ImageRepository struct {
 
 // DownloadProgress represents the progress of an image download
 type DownloadProgress struct {
-	ImageName     string `json:"image_name"`
-	TotalBytes    int64  `json:"total_bytes"`
-	Downloaded    int64  `json:"downloaded"`
+	ImageName     string  `json:"image_name"`
+	TotalBytes    int64   `json:"total_bytes"`
+	Downloaded    int64   `json:"downloaded"`
 	Percentage    float64 `json:"percentage"`
 	Speed         string  `json:"speed"`
 	TimeRemaining string  `json:"time_remaining"`
-}
\ No newline at end of file
+}
@@ -0,0 +1,351 @@
+// Package iso9660 writes small ISO9660 images with Joliet extensions.
+//
+// It only supports what is needed for cloud-init seed images: a single
+// root directory holding a handful of regular files.
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const sectorSize = 2048
+
+// Sector layout of the image. Everything up to the root directories has
+// a fixed position, files follow after them.
+const (
+	sectorPrimary      = 16
+	sectorJoliet       = 17
+	sectorTerminator   = 18
+	sectorPathTableL   = 19
+	sectorPathTableM   = 20
+	sectorJolietTableL = 21
+	sectorJolietTableM = 22
+	sectorRootDirs     = 23
+)
+
+// Writer builds an ISO9660 image in memory
+type Writer struct {
+	volumeID string
+	files    []*file
+	modTime  time.Time
+}
+
+type file struct {
+	name   string
+	data   []byte
+	extent uint32
+}
+
+// NewWriter creates a writer for a volume with the given label
+func NewWriter(volumeID string) *Writer {
+	return &Writer{
+		volumeID: volumeID,
+		modTime:  time.Now().UTC(),
+	}
+}
+
+// AddFile adds a file to the root directory of the image
+func (w *Writer) AddFile(name string, data []byte) error {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid file name: %q", name)
+	}
+	for _, f := range w.files {
+		if f.name == name {
+			return fmt.Errorf("duplicate file name: %q", name)
+		}
+	}
+
+	w.files = append(w.files, &file{name: name, data: data})
+	return nil
+}
+
+// WriteTo writes the complete image to out
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	sort.Slice(w.files, func(i, j int) bool {
+		return w.files[i].name < w.files[j].name
+	})
+
+	primaryNames := make([][]byte, len(w.files))
+	jolietNames := make([][]byte, len(w.files))
+	for i, f := range w.files {
+		primaryNames[i] = []byte(primaryName(f.name))
+		jolietNames[i] = ucs2(f.name)
+	}
+
+	primaryDirSectors := dirSectors(primaryNames)
+	jolietDirSectors := dirSectors(jolietNames)
+	primaryDir := uint32(sectorRootDirs)
+	jolietDir := primaryDir + primaryDirSectors
+
+	next := jolietDir + jolietDirSectors
+	for _, f := range w.files {
+		f.extent = next
+		next += sectorsFor(len(f.data))
+	}
+	totalSectors := next
+
+	buf := &bytes.Buffer{}
+	buf.Grow(int(totalSectors) * sectorSize)
+
+	// System area
+	buf.Write(make([]byte, sectorPrimary*sectorSize))
+
+	primaryRoot := w.dirRecord(nil, primaryDir, primaryDirSectors*sectorSize, true)
+	jolietRoot := w.dirRecord(nil, jolietDir, jolietDirSectors*sectorSize, true)
+
+	buf.Write(w.volumeDescriptor(1, totalSectors, primaryRoot, sectorPathTableL, sectorPathTableM))
+	buf.Write(w.volumeDescriptor(2, totalSectors, jolietRoot, sectorJolietTableL, sectorJolietTableM))
+	buf.Write(terminator())
+
+	buf.Write(pathTable(primaryDir, binary.LittleEndian))
+	buf.Write(pathTable(primaryDir, binary.BigEndian))
+	buf.Write(pathTable(jolietDir, binary.LittleEndian))
+	buf.Write(pathTable(jolietDir, binary.BigEndian))
+
+	buf.Write(w.directory(primaryNames, primaryDir, primaryDirSectors))
+	buf.Write(w.directory(jolietNames, jolietDir, jolietDirSectors))
+
+	for _, f := range w.files {
+		buf.Write(pad(f.data))
+	}
+
+	return buf.WriteTo(out)
+}
+
+// volumeDescriptor builds a primary (type 1) or Joliet supplementary
+// (type 2) volume descriptor
+func (w *Writer) volumeDescriptor(kind byte, totalSectors uint32, root []byte, tableL, tableM uint32) []byte {
+	d := make([]byte, sectorSize)
+	d[0] = kind
+	copy(d[1:6], "CD001")
+	d[6] = 1
+
+	text := func(offset, length int, value string) {
+		if kind == 2 {
+			copy(d[offset:offset+length], ucs2Padded(value, length))
+		} else {
+			copy(d[offset:offset+length], padded(value, length))
+		}
+	}
+
+	text(8, 32, "LINUX")
+	text(40, 32, w.volumeID)
+	putBoth32(d[80:], totalSectors)
+	if kind == 2 {
+		// UCS-2 level 3
+		copy(d[88:91], "%/E")
+	}
+	putBoth16(d[120:], 1)
+	putBoth16(d[124:], 1)
+	putBoth16(d[128:], sectorSize)
+	putBoth32(d[132:], uint32(len(rootPathTableEntry(0, binary.LittleEndian))))
+	binary.LittleEndian.PutUint32(d[140:], tableL)
+	binary.BigEndian.PutUint32(d[148:], tableM)
+	copy(d[156:190], root)
+	text(190, 128, "")
+	text(318, 128, "")
+	text(446, 128, "")
+	text(574, 128, "SLACKPASS")
+	text(702, 37, "")
+	text(739, 37, "")
+	text(776, 37, "")
+
+	created := longDate(w.modTime)
+	copy(d[813:], created)
+	copy(d[830:], created)
+	copy(d[847:], longDate(time.Time{}))
+	copy(d[864:], created)
+	d[881] = 1
+
+	return d
+}
+
+// directory builds the root directory extent with its "." and ".."
+// entries followed by one record per file
+func (w *Writer) directory(names [][]byte, extent, sectors uint32) []byte {
+	records := [][]byte{
+		w.dirRecord([]byte{0}, extent, sectors*sectorSize, true),
+		w.dirRecord([]byte{1}, extent, sectors*sectorSize, true),
+	}
+	for i, f := range w.files {
+		records = append(records, w.dirRecord(names[i], f.extent, uint32(len(f.data)), false))
+	}
+
+	d := make([]byte, 0, sectors*sectorSize)
+	for _, record := range records {
+		// Records may not cross a sector boundary
+		if used := len(d) % sectorSize; used+len(record) > sectorSize {
+			d = append(d, make([]byte, sectorSize-used)...)
+		}
+		d = append(d, record...)
+	}
+
+	return pad(d)
+}
+
+// dirRecord builds a single directory record. A nil identifier produces
+// the 34 byte root record embedded in the volume descriptors.
+func (w *Writer) dirRecord(identifier []byte, extent, size uint32, dir bool) []byte {
+	if identifier == nil {
+		identifier = []byte{0}
+	}
+
+	length := 33 + len(identifier)
+	if length%2 != 0 {
+		length++
+	}
+
+	r := make([]byte, length)
+	r[0] = byte(length)
+	putBoth32(r[2:], extent)
+	putBoth32(r[10:], size)
+	copy(r[18:25], shortDate(w.modTime))
+	if dir {
+		r[25] = 0x02
+	}
+	putBoth16(r[28:], 1)
+	r[32] = byte(len(identifier))
+	copy(r[33:], identifier)
+
+	return r
+}
+
+// dirSectors returns the number of sectors needed by a root directory
+// holding files with the given identifiers
+func dirSectors(names [][]byte) uint32 {
+	sectors, used := uint32(1), 34*2
+	for _, name := range names {
+		length := 33 + len(name)
+		if length%2 != 0 {
+			length++
+		}
+		if used+length > sectorSize {
+			sectors++
+			used = 0
+		}
+		used += length
+	}
+	return sectors
+}
+
+// pathTable builds a path table holding only the root directory
+func pathTable(rootExtent uint32, order binary.ByteOrder) []byte {
+	return pad(rootPathTableEntry(rootExtent, order))
+}
+
+func rootPathTableEntry(rootExtent uint32, order binary.ByteOrder) []byte {
+	e := make([]byte, 10)
+	e[0] = 1
+	order.PutUint32(e[2:], rootExtent)
+	order.PutUint16(e[6:], 1)
+	return e
+}
+
+func terminator() []byte {
+	d := make([]byte, sectorSize)
+	d[0] = 255
+	copy(d[1:6], "CD001")
+	d[6] = 1
+	return d
+}
+
+// primaryName maps a file name to ISO9660 d-characters with a version
+// suffix, e.g. "user-data" becomes "USER_DATA.;1"
+func primaryName(name string) string {
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+
+	clean := func(s string, max int) string {
+		var b strings.Builder
+		for _, r := range strings.ToUpper(s) {
+			if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+				b.WriteRune(r)
+			} else {
+				b.WriteRune('_')
+			}
+		}
+		out := b.String()
+		if len(out) > max {
+			out = out[:max]
+		}
+		return out
+	}
+
+	return fmt.Sprintf("%s.%s;1", clean(base, 30), clean(ext, 3))
+}
+
+func ucs2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, len(units)*2)
+	for i, u := range units {
+		binary.BigEndian.PutUint16(b[i*2:], u)
+	}
+	return b
+}
+
+func ucs2Padded(s string, length int) []byte {
+	b := make([]byte, length)
+	for i := 0; i+1 < length; i += 2 {
+		binary.BigEndian.PutUint16(b[i:], ' ')
+	}
+	copy(b, ucs2(s))
+	return b
+}
+
+func padded(s string, length int) []byte {
+	b := bytes.Repeat([]byte{' '}, length)
+	copy(b, s)
+	return b
+}
+
+func pad(data []byte) []byte {
+	if rem := len(data) % sectorSize; rem != 0 {
+		return append(data, make([]byte, sectorSize-rem)...)
+	}
+	return data
+}
+
+func sectorsFor(size int) uint32 {
+	return uint32((size + sectorSize - 1) / sectorSize)
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// shortDate encodes the 7 byte date used in directory records
+func shortDate(t time.Time) []byte {
+	return []byte{
+		byte(t.Year() - 1900),
+		byte(t.Month()),
+		byte(t.Day()),
+		byte(t.Hour()),
+		byte(t.Minute()),
+		byte(t.Second()),
+		0,
+	}
+}
+
+// longDate encodes the 17 byte date used in volume descriptors. The zero
+// time encodes as "not specified".
+func longDate(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte("0000000000000000"), 0)
+	}
+	return append([]byte(t.Format("20060102150405")+"00"), 0)
+}
@@ -0,0 +1,320 @@
+package kvm
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveVersion is the version of the export archive format. Archives
+// with a newer version are rejected on import.
+const archiveVersion = 1
+
+// manifestName is the first entry of every export archive
+const manifestName = "manifest.json"
+
+// archiveFiles are the instance files stored in an export archive, in
+// the order they are written
+var archiveFiles = []string{"metadata.json", "cloud-init.json", "cloud-init.iso", "disk.qcow2"}
+
+// optionalArchiveFiles are stored after archiveFiles when the instance
+// has them
+var optionalArchiveFiles = []string{"id_ed25519", "id_ed25519.pub", "id_rsa", "id_rsa.pub"}
+
+// Manifest describes the contents of an export archive
+type Manifest struct {
+	Version    int       `json:"version"`
+	Name       string    `json:"name"`
+	Image      string    `json:"image"`
+	ExportedAt time.Time `json:"exported_at"`
+	Files      []string  `json:"files"`
+}
+
+// Export writes a stopped or running instance to w as a zstd compressed
+// tar archive. The disk is flattened so the archive does not depend on
+// the base image.
+func (c *Client) Export(name string, w io.Writer) error {
+	metadata, err := c.getMetadata(name)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	switch VMState(metadata.State) {
+	case StateStopped, StateRunning:
+	default:
+		return fmt.Errorf("cannot export '%s' while it is %s", name, metadata.State)
+	}
+
+	instanceDir := filepath.Join(c.config.InstancesDir, name)
+	diskPath := filepath.Join(instanceDir, "export.qcow2")
+	if err := c.copyDisk(metadata, diskPath, false); err != nil {
+		os.Remove(diskPath)
+		return fmt.Errorf("failed to flatten disk: %w", err)
+	}
+	defer os.Remove(diskPath)
+
+	sources := map[string]string{
+		"metadata.json":   filepath.Join(instanceDir, "metadata.json"),
+		"cloud-init.json": filepath.Join(instanceDir, "cloud-init.json"),
+		"cloud-init.iso":  metadata.CloudInit,
+		"disk.qcow2":      diskPath,
+	}
+
+	files := append([]string{}, archiveFiles...)
+	for _, file := range optionalArchiveFiles {
+		path := filepath.Join(instanceDir, file)
+		if _, err := os.Stat(path); err == nil {
+			sources[file] = path
+			files = append(files, file)
+		}
+	}
+
+	manifest, err := json.MarshalIndent(&Manifest{
+		Version:    archiveVersion,
+		Name:       name,
+		Image:      metadata.Image,
+		ExportedAt: time.Now(),
+		Files:      files,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(manifest)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := addArchiveFile(tw, file, sources[file]); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", file, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Import restores an instance from an export archive read from r. An
+// empty name keeps the name the instance was exported under. Host
+// specific state such as the PID, SSH port and MAC address is reset, and
+// port forwards that clash with other instances are dropped.
+func (c *Client) Import(r io.Reader, name string) (*InstanceMetadata, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	manifest, err := readManifest(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = manifest.Name
+	}
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	instanceDir := filepath.Join(c.config.InstancesDir, name)
+	if err := os.Mkdir(instanceDir, 0755); err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("instance '%s' already exists", name)
+		}
+		return nil, fmt.Errorf("failed to create instance directory: %w", err)
+	}
+
+	metadata, err := c.importInstance(tr, manifest, name, instanceDir)
+	if err != nil {
+		os.RemoveAll(instanceDir)
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// importInstance extracts the files of an archive into a new instance
+// directory and rewrites the metadata for this host
+func (c *Client) importInstance(tr *tar.Reader, manifest *Manifest, name, instanceDir string) (*InstanceMetadata, error) {
+	expected := make(map[string]bool, len(manifest.Files))
+	for _, file := range manifest.Files {
+		expected[file] = true
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		if !expected[header.Name] || header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected entry in archive: %s", header.Name)
+		}
+		delete(expected, header.Name)
+
+		path := filepath.Join(instanceDir, header.Name)
+		if err := extractArchiveFile(tr, path, os.FileMode(header.Mode).Perm()); err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %w", header.Name, err)
+		}
+	}
+
+	for file := range expected {
+		return nil, fmt.Errorf("archive is missing %s", file)
+	}
+
+	metadata, err := c.loadMetadata(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	metadata.Name = name
+	metadata.BaseImage = ""
+	metadata.DiskPath = filepath.Join(instanceDir, "disk.qcow2")
+	metadata.CloudInit = filepath.Join(instanceDir, "cloud-init.iso")
+	metadata.MAC = generateMAC()
+	metadata.State = string(StateStopped)
+	metadata.PID = 0
+	metadata.SSHPort = 0
+	metadata.IPv4 = ""
+	metadata.Mounts = nil // The shared directories are on the exporting host
+	metadata.Forwards = c.importForwards(name, metadata.Forwards)
+
+	metadataPath := filepath.Join(instanceDir, "metadata.json")
+	if err := c.saveMetadata(metadata, metadataPath); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// importForwards returns the port forwards of an imported instance that
+// do not clash with the forwards and SSH ports of other instances on this
+// host, warning about the ones that are dropped
+func (c *Client) importForwards(name string, forwards []PortForward) []PortForward {
+	reserved := c.reservedPorts(name)
+
+	var kept []PortForward
+	for _, forward := range forwards {
+		key := portKey(forward.Protocol, forward.HostPort)
+		if reserved[key] {
+			fmt.Fprintf(os.Stderr, "Warning: dropped forward of %s host port %d, it is used by another instance\n",
+				forward.Protocol, forward.HostPort)
+			continue
+		}
+		reserved[key] = true
+		kept = append(kept, forward)
+	}
+	return kept
+}
+
+// readManifest reads and checks the manifest at the start of an archive
+func readManifest(tr *tar.Reader) (*Manifest, error) {
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	if header.Name != manifestName {
+		return nil, fmt.Errorf("not a slackpass archive: %s is missing", manifestName)
+	}
+
+	var manifest Manifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+
+	if manifest.Version < 1 || manifest.Version > archiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	if manifest.Name == "" {
+		return nil, fmt.Errorf("invalid manifest: no instance name")
+	}
+	for _, file := range archiveFiles {
+		if !contains(manifest.Files, file) {
+			return nil, fmt.Errorf("invalid manifest: %s is not listed", file)
+		}
+	}
+	for _, file := range manifest.Files {
+		if !contains(archiveFiles, file) && !contains(optionalArchiveFiles, file) {
+			return nil, fmt.Errorf("invalid manifest: unknown file %s", file)
+		}
+	}
+
+	return &manifest, nil
+}
+
+// addArchiveFile streams the file at path into the archive as name
+func addArchiveFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    int64(st.Mode().Perm()),
+		Size:    st.Size(),
+		ModTime: st.ModTime(),
+	}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// extractArchiveFile streams the current archive entry to a new file at
+// path with the given permissions
+func extractArchiveFile(r io.Reader, path string, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -7,6 +7,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/slackpass/slackpass/internal/config"
@@ -26,123 +27,281 @@ func NewClient(cfg *config.Config) *Client {
 
 // VMConfig represents the configuration for a virtual machine
 type VMConfig struct {
-	Name      string
-	ImagePath string
-	CPUs      int
-	Memory    string
-	Disk      string
-	CloudInit string
+	Name        string
+	Image       string // Image name, e.g. "debian:bookworm"
+	ImagePath   string // Path of the cached base image
+	CPUs        int
+	Memory      string
+	Disk        string
+	User        string            // Login user of the instance
+	DefaultUser string            // Default user of the image
+	CloudInit   string            // Path to a user supplied cloud-config file
+	SSHKeys     []string          // Public keys authorized in the guest
+	Network     *NetworkInterface // Network attachment, nil for user-mode networking
+	Forwards    []PortForward     // Host ports forwarded to the guest
+	Mounts      []Mount           // Host directories shared with the guest
 }
 
 // Create creates a new virtual machine
 func (c *Client) Create(config *VMConfig) error {
 	instanceDir := filepath.Join(c.config.InstancesDir, config.Name)
 
-	// Create disk image
+	// The base image is recorded by its absolute path so it can be
+	// compared with that of other instances
+	basePath := config.ImagePath
+	if basePath != "" {
+		abs, err := filepath.Abs(basePath)
+		if err != nil {
+			return fmt.Errorf("failed to resolve base image path: %w", err)
+		}
+		basePath = abs
+	}
+
+	// Create disk image as an overlay on top of the base image
 	diskPath := filepath.Join(instanceDir, "disk.qcow2")
-	if err := c.createDiskImage(config.ImagePath, diskPath, config.Disk); err != nil {
+	if err := c.createDiskImage(basePath, diskPath, config.Disk); err != nil {
 		return fmt.Errorf("failed to create disk image: %w", err)
 	}
 
-	// Generate cloud-init ISO if needed
-	var cloudInitPath string
-	if config.CloudInit != "" {
-		cloudInitPath = filepath.Join(instanceDir, "cloud-init.iso")
-		if err := c.createCloudInitISO(config.CloudInit, cloudInitPath); err != nil {
-			return fmt.Errorf("failed to create cloud-init ISO: %w", err)
-		}
+	// Generate cloud-init seed ISO
+	instanceID := generateInstanceID()
+	cloudInit, err := c.buildCloudInitConfig(config, instanceID)
+	if err != nil {
+		return fmt.Errorf("failed to build cloud-init config: %w", err)
+	}
+
+	cloudInitPath := filepath.Join(instanceDir, "cloud-init.iso")
+	if err := c.createCloudInitISO(cloudInit, cloudInitPath); err != nil {
+		return fmt.Errorf("failed to create cloud-init ISO: %w", err)
 	}
 
 	// Save instance metadata
+	mac := generateMAC()
+	network, bridge := NetworkUser, ""
+	if config.Network != nil {
+		network, bridge = config.Network.Type, config.Network.Bridge
+		if config.Network.MAC != "" {
+			mac = config.Network.MAC
+		}
+	}
+
+	var mounts []Mount
+	for _, mount := range config.Mounts {
+		mount.Tag = nextMountTag(mounts)
+		mounts = append(mounts, mount)
+	}
+
 	metadata := &InstanceMetadata{
-		Name:      config.Name,
-		Image:     config.ImagePath,
-		CPUs:      config.CPUs,
-		Memory:    config.Memory,
-		Disk:      config.Disk,
-		DiskPath:  diskPath,
-		CloudInit: cloudInitPath,
-		CreatedAt: time.Now(),
-		State:     string(StateStopped),
+		Name:       config.Name,
+		Image:      config.Image,
+		BaseImage:  basePath,
+		CPUs:       config.CPUs,
+		Memory:     config.Memory,
+		Disk:       config.Disk,
+		DiskPath:   diskPath,
+		User:       config.User,
+		CloudInit:  cloudInitPath,
+		InstanceID: instanceID,
+		Network:    network,
+		Bridge:     bridge,
+		MAC:        mac,
+		Forwards:   config.Forwards,
+		Mounts:     mounts,
+		CreatedAt:  time.Now(),
+		State:      string(StateStopped),
 	}
 
 	metadataPath := filepath.Join(instanceDir, "metadata.json")
 	return c.saveMetadata(metadata, metadataPath)
 }
 
-// Start starts a virtual machine
+// Start starts a virtual machine, resuming it from its saved state when
+// it was suspended
 func (c *Client) Start(name string) error {
-	metadata, err := c.loadMetadata(name)
+	metadata, err := c.getMetadata(name)
 	if err != nil {
 		return fmt.Errorf("failed to load metadata: %w", err)
 	}
 
-	if metadata.State == string(StateRunning) {
+	if isActive(metadata.State) {
 		return fmt.Errorf("instance '%s' is already running", name)
 	}
 
+	if metadata.Network == NetworkBridge {
+		// The guest gets its own address, learned once it is up
+		metadata.SSHPort = 0
+		metadata.IPv4 = ""
+	} else {
+		// Hold the port lock until QEMU has bound the forwarded port
+		unlock, err := c.lockPorts()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		port, err := c.allocateSSHPort(metadata)
+		if err != nil {
+			return fmt.Errorf("failed to allocate SSH port: %w", err)
+		}
+		metadata.SSHPort = port
+
+		// Refuse to start rather than have QEMU fail on a taken port
+		if err := c.checkForwards(metadata); err != nil {
+			return err
+		}
+	}
+
+	// Each boot gets a console log of its own, a resumed instance
+	// carries on with the log of the boot it was suspended in
+	if !c.hasSuspendState(name) {
+		if err := c.rotateConsoleLog(name); err != nil {
+			return fmt.Errorf("failed to rotate console log: %w", err)
+		}
+	}
+
+	metadataPath := filepath.Join(c.config.InstancesDir, name, "metadata.json")
+	metadata.State = string(StateStarting)
+	if err := c.saveMetadata(metadata, metadataPath); err != nil {
+		return err
+	}
+
+	// virtiofsd has to be listening before QEMU connects to it
+	stopVirtiofsd, err := c.startVirtiofsd(metadata)
+	if err != nil {
+		metadata.State = string(StateStopped)
+		c.saveMetadata(metadata, metadataPath)
+		return err
+	}
+
 	// Build QEMU command
 	cmd := c.buildQEMUCommand(metadata)
 
-	// Start the VM
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start VM: %w", err)
+	// Start the VM. With -daemonize the command returns once the guest
+	// has been set up and the pidfile has been written.
+	if output, err := cmd.CombinedOutput(); err != nil {
+		stopVirtiofsd()
+		metadata.State = string(StateStopped)
+		c.saveMetadata(metadata, metadataPath)
+		return fmt.Errorf("failed to start VM: %w: %s", err, strings.TrimSpace(string(output)))
 	}
 
-	// Update state
-	metadata.State = string(StateRunning)
-	metadata.PID = cmd.Process.Pid
-	metadataPath := filepath.Join(c.config.InstancesDir, name, "metadata.json")
+	// A suspended instance is still loading its saved state
+	if c.hasSuspendState(name) {
+		if err := c.finishResume(name); err != nil {
+			// Stop the half resumed QEMU and keep the saved state for
+			// another try
+			metadata.PID = c.runningPID(name)
+			c.shutdown(metadata, true)
+			stopVirtiofsd()
+			metadata.State = string(StateSuspended)
+			metadata.PID = 0
+			c.saveMetadata(metadata, metadataPath)
+			return err
+		}
+	}
+
+	// Update state from the daemonized process
+	state, pid := c.actualState(metadata)
+	metadata.State = string(state)
+	metadata.PID = pid
 	return c.saveMetadata(metadata, metadataPath)
 }
 
 // Stop stops a virtual machine
 func (c *Client) Stop(name string, force bool) error {
-	metadata, err := c.loadMetadata(name)
+	metadata, err := c.getMetadata(name)
 	if err != nil {
 		return fmt.Errorf("failed to load metadata: %w", err)
 	}
 
-	if metadata.State != string(StateRunning) {
+	metadataPath := filepath.Join(c.config.InstancesDir, name, "metadata.json")
+
+	// Stopping a suspended instance throws away its saved state
+	if metadata.State == string(StateSuspended) {
+		if !force {
+			return fmt.Errorf("instance '%s' is suspended, use --force to discard its saved state", name)
+		}
+		if err := os.Remove(c.suspendStatePath(name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove saved state: %w", err)
+		}
+		metadata.State = string(StateStopped)
+		return c.saveMetadata(metadata, metadataPath)
+	}
+
+	if !isActive(metadata.State) {
 		return fmt.Errorf("instance '%s' is not running", name)
 	}
 
-	// Send shutdown signal to QEMU process
-	if metadata.PID > 0 {
-		process, err := os.FindProcess(metadata.PID)
-		if err == nil {
-			if force {
-				process.Kill()
-			} else {
-				process.Signal(os.Interrupt)
-			}
-		}
+	now := time.Now()
+	metadata.State = string(StateStopping)
+	metadata.StopSince = &now
+	if err := c.saveMetadata(metadata, metadataPath); err != nil {
+		return err
+	}
+
+	if err := c.shutdown(metadata, force); err != nil {
+		// The guest is still up, don't leave it looking like it is stopping
+		metadata.State = string(StateRunning)
+		metadata.StopSince = nil
+		c.saveMetadata(metadata, metadataPath)
+		return err
 	}
 
 	// Update state
 	metadata.State = string(StateStopped)
+	metadata.StopSince = nil
 	metadata.PID = 0
-	metadataPath := filepath.Join(c.config.InstancesDir, name, "metadata.json")
 	return c.saveMetadata(metadata, metadataPath)
 }
 
+// shutdown shuts an instance down through QMP, killing the process only
+// as a last resort, and waits for QEMU to exit
+func (c *Client) shutdown(metadata *InstanceMetadata, force bool) error {
+	if force {
+		if err := c.quit(metadata.Name); err != nil && metadata.PID > 0 {
+			if process, err := os.FindProcess(metadata.PID); err == nil {
+				process.Kill()
+			}
+		}
+	} else if err := c.powerdown(metadata.Name); err != nil {
+		return err
+	}
+
+	return c.waitForExit(metadata.Name, processExitTimeout)
+}
+
 // Delete deletes a virtual machine
 func (c *Client) Delete(name string, purge, force bool) error {
 	// Stop the VM first if running
-	metadata, err := c.loadMetadata(name)
+	metadata, err := c.getMetadata(name)
 	if err != nil {
 		return fmt.Errorf("failed to load metadata: %w", err)
 	}
 
-	if metadata.State == string(StateRunning) {
+	if isActive(metadata.State) {
 		if err := c.Stop(name, force); err != nil {
 			return fmt.Errorf("failed to stop VM: %w", err)
 		}
 	}
 
-	// Remove instance directory
+	// Remove instance directory, including any saved suspend state
 	instanceDir := filepath.Join(c.config.InstancesDir, name)
-	return os.RemoveAll(instanceDir)
+	if err := os.RemoveAll(instanceDir); err != nil {
+		return err
+	}
+
+	// Let the user know when a base image is no longer needed
+	if purge && metadata.BaseImage != "" && !c.baseImageInUse(metadata.BaseImage) {
+		fmt.Printf("Base image %s is no longer used by any instance\n", metadata.BaseImage)
+	}
+
+	return nil
+}
+
+// Metadata returns the metadata of an instance with its state reconciled
+// against the QEMU process
+func (c *Client) Metadata(name string) (*InstanceMetadata, error) {
+	return c.getMetadata(name)
 }
 
 // List returns all virtual machine instances
@@ -159,10 +318,11 @@ func (c *Client) List() ([]*Instance, error) {
 			continue
 		}
 
-		metadata, err := c.loadMetadata(entry.Name())
+		metadata, err := c.getMetadata(entry.Name())
 		if err != nil {
 			continue // Skip invalid instances
 		}
+		c.refreshAddress(metadata)
 
 		instance := &Instance{
 			Name:   metadata.Name,
@@ -180,17 +340,57 @@ func (c *Client) List() ([]*Instance, error) {
 	return instances, nil
 }
 
+// ListMetadata returns the metadata of all instances, with their state
+// reconciled but without asking the guests for their addresses
+func (c *Client) ListMetadata() ([]*InstanceMetadata, error) {
+	entries, err := os.ReadDir(c.config.InstancesDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var instances []*InstanceMetadata
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		metadata, err := c.getMetadata(entry.Name())
+		if err != nil {
+			continue // Skip invalid instances
+		}
+		instances = append(instances, metadata)
+	}
+
+	return instances, nil
+}
+
 // Info displays detailed information about a virtual machine
 func (c *Client) Info(name string) error {
-	metadata, err := c.loadMetadata(name)
+	metadata, err := c.getMetadata(name)
 	if err != nil {
 		return fmt.Errorf("failed to load metadata: %w", err)
 	}
+	c.refreshAddress(metadata)
 
 	fmt.Printf("Name:           %s\n", metadata.Name)
 	fmt.Printf("State:          %s\n", metadata.State)
 	fmt.Printf("IPv4:           %s\n", metadata.IPv4)
+	if metadata.Network == NetworkBridge {
+		fmt.Printf("Network:        bridge (%s)\n", metadata.Bridge)
+	} else {
+		fmt.Printf("Network:        user (SSH on 127.0.0.1:%d)\n", metadata.SSHPort)
+	}
+	for _, forward := range metadata.Forwards {
+		fmt.Printf("Forward:        %s\n", forward)
+	}
+	for _, mount := range metadata.Mounts {
+		fmt.Printf("Mount:          %s => %s (%s)\n", mount.Source, mount.Target, mount.Type)
+	}
 	fmt.Printf("Image:          %s\n", metadata.Image)
+	fmt.Printf("User:           %s\n", metadata.User)
 	fmt.Printf("CPUs:           %d\n", metadata.CPUs)
 	fmt.Printf("Memory:         %s\n", metadata.Memory)
 	fmt.Printf("Disk:           %s\n", metadata.Disk)
@@ -201,18 +401,6 @@ func (c *Client) Info(name string) error {
 
 // Helper methods
 
-func (c *Client) createDiskImage(sourcePath, targetPath, size string) error {
-	// For now, create an empty disk image
-	// TODO: Implement proper image copying/resizing
-	cmd := exec.Command(c.config.QEMUImgBinary, "create", "-f", "qcow2", targetPath, size)
-	return cmd.Run()
-}
-
-func (c *Client) createCloudInitISO(configPath, isoPath string) error {
-	// TODO: Implement cloud-init ISO creation
-	return nil
-}
-
 func (c *Client) buildQEMUCommand(metadata *InstanceMetadata) *exec.Cmd {
 	args := []string{
 		"-name", metadata.Name,
@@ -220,20 +408,79 @@ func (c *Client) buildQEMUCommand(metadata *InstanceMetadata) *exec.Cmd {
 		"-cpu", "host",
 		"-smp", strconv.Itoa(metadata.CPUs),
 		"-m", metadata.Memory,
-		"-drive", fmt.Sprintf("file=%s,format=qcow2,if=virtio", metadata.DiskPath),
-		"-netdev", "user,id=net0,hostfwd=tcp::0-:22",
-		"-device", "virtio-net-pci,netdev=net0",
-		"-nographic",
+		"-drive", fmt.Sprintf("file=%s,format=qcow2,if=virtio,id=%s,node-name=%s", metadata.DiskPath, diskDeviceID, diskNodeName),
+		"-netdev", c.netdev(metadata),
+		"-device", netDevice(metadata),
+		"-chardev", fmt.Sprintf("socket,id=qmp,path=%s,server=on,wait=off", c.qmpSocketPath(metadata.Name)),
+		"-mon", "chardev=qmp,mode=control",
+		"-chardev", fmt.Sprintf("socket,id=%s,path=%s,server=on,wait=off", agentChardevID, c.agentSocketPath(metadata.Name)),
+		"-device", "virtio-serial",
+		"-device", fmt.Sprintf("virtserialport,chardev=%s,name=org.qemu.guest_agent.0", agentChardevID),
+		"-display", "none",
+		"-pidfile", c.pidFilePath(metadata.Name),
 		"-daemonize",
 	}
 
 	if metadata.CloudInit != "" {
-		args = append(args, "-drive", fmt.Sprintf("file=%s,format=raw,if=virtio", metadata.CloudInit))
+		args = append(args, "-drive", fmt.Sprintf("file=%s,format=raw,if=virtio,readonly=on", metadata.CloudInit))
+	}
+
+	args = append(args, c.consoleArgs(metadata)...)
+	args = append(args, c.mountArgs(metadata)...)
+
+	// Load the saved state of a suspended instance
+	if c.hasSuspendState(metadata.Name) {
+		args = append(args, "-incoming", "exec:cat "+quoteShellArg(c.suspendStatePath(metadata.Name)))
 	}
 
 	return exec.Command(c.config.QEMUBinary, args...)
 }
 
+// ValidateName checks that an instance name can be used as the name of
+// its directory, without reaching outside the instances directory
+func ValidateName(name string) error {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid instance name: %q", name)
+	}
+	return nil
+}
+
+// NormalizeMemory returns a memory size with an explicit unit, in the
+// form QEMU takes for both -m and memory backends. A plain number is
+// taken to be MiB, as -m does.
+func NormalizeMemory(size string) (string, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		s += "M"
+	}
+	// QEMU knows "2G" but not "2GB" or "2GiB"
+	if unit := strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I"); len(unit) > 0 && strings.ContainsAny(unit[len(unit)-1:], "KMGT") {
+		s = unit
+	}
+
+	if _, err := config.ParseSize(s); err != nil {
+		return "", fmt.Errorf("invalid memory size: %w", err)
+	}
+	return s, nil
+}
+
+// instanceKeyFiles are the names the private key of an instance may have
+var instanceKeyFiles = []string{"id_ed25519", "id_rsa"}
+
+// KeyPath returns the path of the private key slackpass logs in to an
+// instance with, or where a new key of the configured type goes if the
+// instance has none. The public key is next to it with a .pub suffix.
+func (c *Client) KeyPath(name string) string {
+	instanceDir := filepath.Join(c.config.InstancesDir, name)
+	for _, file := range instanceKeyFiles {
+		path := filepath.Join(instanceDir, file)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(instanceDir, "id_"+c.config.SSHKeyType)
+}
+
 func (c *Client) loadMetadata(name string) (*InstanceMetadata, error) {
 	metadataPath := filepath.Join(c.config.InstancesDir, name, "metadata.json")
 	data, err := os.ReadFile(metadataPath)
@@ -247,10 +494,11 @@ func (c *Client) loadMetadata(name string) (*InstanceMetadata, error) {
 }
 
 func (c *Client) saveMetadata(metadata *InstanceMetadata, path string) error {
+	metadata.UpdatedAt = time.Now()
 	data, err := json.MarshalIndent(metadata, "", "  ")
 	if err != nil {
 		return err
 	}
 
 	return os.WriteFile(path, data, 0644)
-}
\ No newline at end of file
+}
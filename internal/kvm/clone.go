@@ -0,0 +1,157 @@
+package kvm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// copySnapshotPrefix names the temporary internal snapshot the disk of a
+// running instance is copied from
+const copySnapshotPrefix = "slackpass-copy-"
+
+// machineIDReset regenerates the machine-id on the first boot of a clone
+// so it does not share one with its source
+const machineIDReset = `#cloud-config
+runcmd:
+  - rm -f /etc/machine-id /var/lib/dbus/machine-id
+  - systemd-machine-id-setup
+`
+
+// Clone creates a stopped copy of an instance under a new name. The copy
+// gets its own disk, MAC address and cloud-init instance-id so the guest
+// runs its per-instance setup again on first boot. A running instance is
+// copied from a temporary internal snapshot so the disk is consistent.
+func (c *Client) Clone(source, name string) (*InstanceMetadata, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	metadata, err := c.getMetadata(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	switch VMState(metadata.State) {
+	case StateStopped, StateRunning:
+	default:
+		return nil, fmt.Errorf("cannot clone '%s' while it is %s", source, metadata.State)
+	}
+
+	ci, err := c.loadCloudInitConfig(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cloud-init config: %w", err)
+	}
+
+	instanceDir := filepath.Join(c.config.InstancesDir, name)
+	if err := os.Mkdir(instanceDir, 0755); err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("instance '%s' already exists", name)
+		}
+		return nil, fmt.Errorf("failed to create instance directory: %w", err)
+	}
+
+	clone, err := c.cloneInstance(metadata, ci, name, instanceDir)
+	if err != nil {
+		os.RemoveAll(instanceDir)
+		return nil, err
+	}
+
+	return clone, nil
+}
+
+// cloneInstance fills the directory of a new clone
+func (c *Client) cloneInstance(metadata *InstanceMetadata, ci *CloudInitConfig, name, instanceDir string) (*InstanceMetadata, error) {
+	diskPath := filepath.Join(instanceDir, "disk.qcow2")
+	if err := c.copyDisk(metadata, diskPath, true); err != nil {
+		return nil, fmt.Errorf("failed to copy disk: %w", err)
+	}
+
+	// A new instance-id makes cloud-init treat the clone as a new instance
+	instanceID := generateInstanceID()
+	ci.MetaData = renderMetaData(instanceID, name)
+	if !strings.Contains(ci.UserData, "systemd-machine-id-setup") {
+		userData, err := mergeUserData(ci.UserData, []byte(machineIDReset))
+		if err != nil {
+			return nil, fmt.Errorf("failed to build cloud-init config: %w", err)
+		}
+		ci.UserData = userData
+	}
+
+	cloudInitPath := filepath.Join(instanceDir, "cloud-init.iso")
+	if err := c.createCloudInitISO(ci, cloudInitPath); err != nil {
+		return nil, fmt.Errorf("failed to create cloud-init ISO: %w", err)
+	}
+
+	clone := *metadata
+	clone.Name = name
+	clone.DiskPath = diskPath
+	clone.CloudInit = cloudInitPath
+	clone.InstanceID = instanceID
+	clone.MAC = generateMAC()
+	clone.State = string(StateStopped)
+	clone.PID = 0
+	clone.SSHPort = 0
+	clone.IPv4 = ""
+	clone.Forwards = nil // The host ports belong to the source
+	clone.CreatedAt = time.Now()
+
+	metadataPath := filepath.Join(instanceDir, "metadata.json")
+	if err := c.saveMetadata(&clone, metadataPath); err != nil {
+		return nil, err
+	}
+
+	return &clone, nil
+}
+
+// copyDisk copies the disk of an instance to targetPath. With rebase the
+// copy is a new overlay on the same base image, so only the data the
+// instance has written is copied, otherwise the copy is a standalone
+// image. Internal snapshots are not carried over.
+func (c *Client) copyDisk(metadata *InstanceMetadata, targetPath string, rebase bool) error {
+	args := []string{"convert", "-O", "qcow2"}
+
+	if rebase && metadata.BaseImage != "" {
+		base, err := c.diskImageInfo(metadata.BaseImage)
+		if err != nil {
+			return fmt.Errorf("failed to inspect base image: %w", err)
+		}
+		args = append(args, "-B", metadata.BaseImage, "-F", base.Format)
+	}
+
+	if metadata.State != string(StateRunning) {
+		args = append(args, metadata.DiskPath, targetPath)
+		return c.runQEMUImg(args...)
+	}
+
+	snapshot := fmt.Sprintf("%s%d", copySnapshotPrefix, time.Now().Unix())
+	if err := c.internalSnapshot(metadata.Name, "blockdev-snapshot-internal-sync", snapshot); err != nil {
+		return err
+	}
+	defer c.internalSnapshot(metadata.Name, "blockdev-snapshot-delete-internal-sync", snapshot)
+
+	// The disk is in use by QEMU, the snapshot itself never changes
+	args = append(args, "-U", "-l", "snapshot.name="+snapshot, metadata.DiskPath, targetPath)
+	return c.runQEMUImg(args...)
+}
+
+// internalSnapshot creates or deletes an internal disk-only snapshot of
+// a running instance
+func (c *Client) internalSnapshot(name, command, snapshot string) error {
+	monitor, err := c.connectQMP(name)
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+
+	args := map[string]string{
+		"device": diskNodeName,
+		"name":   snapshot,
+	}
+	if _, err := monitor.Execute(command, args); err != nil {
+		return fmt.Errorf("%s failed: %w", command, err)
+	}
+	return nil
+}
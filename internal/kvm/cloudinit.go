@@ -0,0 +1,333 @@
+package kvm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/slackpass/slackpass/internal/iso9660"
+)
+
+// cloudInitVolumeID is the volume label the NoCloud datasource looks for
+const cloudInitVolumeID = "cidata"
+
+// defaultNetworkData enables DHCP on the first virtio interface
+const defaultNetworkData = `version: 2
+ethernets:
+  primary:
+    match:
+      name: "e*"
+    dhcp4: true
+`
+
+// buildCloudInitConfig builds the seed configuration for a new instance:
+// the distro's default user trusting the slackpass key, plus a sudo user
+// when the instance logs in as someone else, merged with the user's own
+// cloud-config file if one was given
+func (c *Client) buildCloudInitConfig(config *VMConfig, instanceID string) (*CloudInitConfig, error) {
+	ci := &CloudInitConfig{
+		SSHKeys:     config.SSHKeys,
+		Users:       []CloudInitUser{{Name: "default"}},
+		MetaData:    renderMetaData(instanceID, config.Name),
+		NetworkData: defaultNetworkData,
+	}
+
+	if config.User != "" && config.User != config.DefaultUser {
+		ci.Users = append(ci.Users, CloudInitUser{
+			Name:              config.User,
+			SSHAuthorizedKeys: config.SSHKeys,
+			Sudo:              "ALL=(ALL) NOPASSWD:ALL",
+			Shell:             "/bin/bash",
+		})
+	}
+
+	userData, err := renderUserData(ci)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CloudInit != "" {
+		custom, err := os.ReadFile(config.CloudInit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cloud-init file: %w", err)
+		}
+
+		userData, err = mergeUserData(userData, custom)
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge %s: %w", config.CloudInit, err)
+		}
+	}
+
+	ci.UserData = userData
+	return ci, nil
+}
+
+// createCloudInitISO writes a NoCloud seed image for the given config and
+// keeps the config next to it so the seed can be regenerated later
+func (c *Client) createCloudInitISO(ci *CloudInitConfig, isoPath string) error {
+	iso := iso9660.NewWriter(cloudInitVolumeID)
+	if err := iso.AddFile("user-data", []byte(ci.UserData)); err != nil {
+		return err
+	}
+	if err := iso.AddFile("meta-data", []byte(ci.MetaData)); err != nil {
+		return err
+	}
+	// NoCloud reads the network data from a file named network-config
+	if err := iso.AddFile("network-config", []byte(ci.NetworkData)); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(isoPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := iso.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(ci, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(filepath.Dir(isoPath), "cloud-init.json"), data, 0644)
+}
+
+// loadCloudInitConfig reads the seed configuration kept next to the seed
+// image of an instance
+func (c *Client) loadCloudInitConfig(name string) (*CloudInitConfig, error) {
+	data, err := os.ReadFile(filepath.Join(c.config.InstancesDir, name, "cloud-init.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ci CloudInitConfig
+	if err := json.Unmarshal(data, &ci); err != nil {
+		return nil, err
+	}
+	return &ci, nil
+}
+
+// ReplaceSSHKey replaces an authorized key in the seed of an instance, so
+// that cloud-init does not authorize the old key again when it runs for a
+// new instance-id. The old key is matched on its type and key material,
+// whatever its comment.
+func (c *Client) ReplaceSSHKey(name, oldKey, newKey string) error {
+	metadata, err := c.loadMetadata(name)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	ci, err := c.loadCloudInitConfig(name)
+	if err != nil {
+		return fmt.Errorf("failed to load cloud-init config: %w", err)
+	}
+	replaceSeedKey(ci, oldKey, newKey)
+
+	// QEMU keeps the old seed open, so the new one is moved over it
+	// rather than written in place
+	partPath := metadata.CloudInit + ".part"
+	if err := c.createCloudInitISO(ci, partPath); err != nil {
+		os.Remove(partPath)
+		return fmt.Errorf("failed to create cloud-init ISO: %w", err)
+	}
+	return os.Rename(partPath, metadata.CloudInit)
+}
+
+// RekeyClone makes a stopped clone trust newKey instead of oldKey, the
+// key of its source. The seed authorizes the new key, and the old one,
+// which the copied disk still trusts, is removed on the first boot.
+func (c *Client) RekeyClone(name, oldKey, newKey string) error {
+	metadata, err := c.loadMetadata(name)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	ci, err := c.loadCloudInitConfig(name)
+	if err != nil {
+		return fmt.Errorf("failed to load cloud-init config: %w", err)
+	}
+	replaceSeedKey(ci, oldKey, newKey)
+
+	// runcmd runs after cloud-init has authorized the new key
+	revoke, err := marshalCloudConfig(map[string]interface{}{
+		"runcmd": []interface{}{
+			[]string{"sh", "-c", revokeKeyScript, "sh", oldKey},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if ci.UserData, err = mergeUserData(ci.UserData, []byte(revoke)); err != nil {
+		return fmt.Errorf("failed to build cloud-init config: %w", err)
+	}
+
+	if err := c.createCloudInitISO(ci, metadata.CloudInit); err != nil {
+		return fmt.Errorf("failed to create cloud-init ISO: %w", err)
+	}
+	return nil
+}
+
+// revokeKeyScript removes the key given as $1 from every user in the
+// guest, rewriting the files in place to keep their owner and permissions
+const revokeKeyScript = `for f in /root/.ssh/authorized_keys /home/*/.ssh/authorized_keys; do
+  [ -f "$f" ] || continue
+  grep -vF "$1" "$f" > "$f.new"
+  cat "$f.new" > "$f"
+  rm -f "$f.new"
+done`
+
+// replaceSeedKey replaces oldKey, matched on its type and key material
+// whatever its comment, with newKey in a seed configuration
+func replaceSeedKey(ci *CloudInitConfig, oldKey, newKey string) {
+	replace := func(keys []string) {
+		for i, key := range keys {
+			if strings.HasPrefix(key, oldKey) {
+				ci.UserData = strings.ReplaceAll(ci.UserData, key, newKey)
+				keys[i] = newKey
+			}
+		}
+	}
+	replace(ci.SSHKeys)
+	for _, user := range ci.Users {
+		replace(user.SSHAuthorizedKeys)
+	}
+}
+
+// renderMetaData renders the NoCloud meta-data document
+func renderMetaData(instanceID, hostname string) string {
+	return fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", instanceID, hostname)
+}
+
+// renderUserData renders the cloud-config document for a CloudInitConfig
+func renderUserData(ci *CloudInitConfig) (string, error) {
+	doc := map[string]interface{}{}
+
+	if len(ci.Users) > 0 {
+		users := make([]interface{}, 0, len(ci.Users))
+		for _, user := range ci.Users {
+			users = append(users, renderUser(user))
+		}
+		doc["users"] = users
+	}
+	if len(ci.SSHKeys) > 0 {
+		doc["ssh_authorized_keys"] = ci.SSHKeys
+	}
+	if len(ci.Packages) > 0 {
+		doc["packages"] = ci.Packages
+	}
+	if len(ci.RunCommands) > 0 {
+		doc["runcmd"] = ci.RunCommands
+	}
+	if len(ci.WriteFiles) > 0 {
+		files := make([]interface{}, 0, len(ci.WriteFiles))
+		for _, file := range ci.WriteFiles {
+			entry := map[string]interface{}{
+				"path":    file.Path,
+				"content": file.Content,
+			}
+			if file.Permissions != "" {
+				entry["permissions"] = file.Permissions
+			}
+			if file.Owner != "" {
+				entry["owner"] = file.Owner
+			}
+			files = append(files, entry)
+		}
+		doc["write_files"] = files
+	}
+
+	return marshalCloudConfig(doc)
+}
+
+// renderUser renders a cloud-init user entry. The special "default" user
+// refers to the distro's own default user and is written as a plain string.
+func renderUser(user CloudInitUser) interface{} {
+	if user.Name == "default" {
+		return "default"
+	}
+
+	entry := map[string]interface{}{"name": user.Name}
+	if len(user.SSHAuthorizedKeys) > 0 {
+		entry["ssh_authorized_keys"] = user.SSHAuthorizedKeys
+	}
+	if user.Sudo != "" {
+		entry["sudo"] = user.Sudo
+	}
+	if user.Shell != "" {
+		entry["shell"] = user.Shell
+	}
+	if len(user.Groups) > 0 {
+		entry["groups"] = strings.Join(user.Groups, ", ")
+	}
+	return entry
+}
+
+// mergeUserData merges a user supplied cloud-config document into the
+// generated defaults. Lists are appended, mappings merged recursively and
+// any other value given by the user replaces the default.
+func mergeUserData(defaults string, custom []byte) (string, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(custom), []byte("#cloud-config")) {
+		return "", fmt.Errorf("only #cloud-config files are supported")
+	}
+
+	var base, overlay map[string]interface{}
+	if err := yaml.Unmarshal([]byte(defaults), &base); err != nil {
+		return "", err
+	}
+	if err := yaml.Unmarshal(custom, &overlay); err != nil {
+		return "", fmt.Errorf("invalid YAML: %w", err)
+	}
+
+	return marshalCloudConfig(mergeValues(base, overlay).(map[string]interface{}))
+}
+
+func mergeValues(base, overlay interface{}) interface{} {
+	switch o := overlay.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			return o
+		}
+		merged := make(map[string]interface{}, len(b)+len(o))
+		for k, v := range b {
+			merged[k] = v
+		}
+		for k, v := range o {
+			merged[k] = mergeValues(b[k], v)
+		}
+		return merged
+	case []interface{}:
+		if b, ok := base.([]interface{}); ok {
+			return append(append([]interface{}{}, b...), o...)
+		}
+		return o
+	default:
+		return overlay
+	}
+}
+
+func marshalCloudConfig(doc map[string]interface{}) (string, error) {
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to render cloud-config: %w", err)
+	}
+	return "#cloud-config\n" + string(data), nil
+}
+
+// generateInstanceID returns a fresh cloud-init instance-id
+func generateInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "iid-" + hex.EncodeToString(b)
+}
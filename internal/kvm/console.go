@@ -0,0 +1,122 @@
+package kvm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// consoleChardevID is the id of the chardev the serial console uses
+	consoleChardevID = "serial0"
+
+	// consoleLogBackups is how many console logs of earlier boots are kept
+	consoleLogBackups = 3
+
+	// consoleTailBytes is how far from the end of the console log
+	// ConsoleTail looks for lines
+	consoleTailBytes = 64 * 1024
+)
+
+// ConsoleLogPath returns the file the serial console of an instance is
+// written to
+func (c *Client) ConsoleLogPath(name string) string {
+	return filepath.Join(c.config.InstancesDir, name, "console.log")
+}
+
+// consoleSocketPath returns the path of the serial console socket of an
+// instance
+func (c *Client) consoleSocketPath(name string) string {
+	return filepath.Join(c.config.InstancesDir, name, "console.sock")
+}
+
+// consoleArgs returns the QEMU arguments connecting the serial console to
+// a socket. QEMU also logs everything the guest writes to the console,
+// whether a client is attached or not.
+func (c *Client) consoleArgs(metadata *InstanceMetadata) []string {
+	return []string{
+		"-chardev", fmt.Sprintf("socket,id=%s,path=%s,server=on,wait=off,logfile=%s,logappend=on",
+			consoleChardevID, c.consoleSocketPath(metadata.Name), c.ConsoleLogPath(metadata.Name)),
+		"-serial", "chardev:" + consoleChardevID,
+	}
+}
+
+// rotateConsoleLog moves the console log of the last boot aside, keeping
+// consoleLogBackups of them as console.log.1 (the newest) and up
+func (c *Client) rotateConsoleLog(name string) error {
+	logPath := c.ConsoleLogPath(name)
+	if _, err := os.Stat(logPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	for i := consoleLogBackups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", logPath, i), fmt.Sprintf("%s.%d", logPath, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(logPath, logPath+".1")
+}
+
+// ConnectConsole connects to the serial console of a running instance.
+// QEMU serves one connection at a time, a second one waits until the
+// first is closed.
+func (c *Client) ConnectConsole(name string) (net.Conn, error) {
+	metadata, err := c.getMetadata(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	if metadata.State != string(StateRunning) {
+		return nil, fmt.Errorf("instance '%s' is not running", name)
+	}
+
+	conn, err := net.Dial("unix", c.consoleSocketPath(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the console: %w", err)
+	}
+	return conn, nil
+}
+
+// ConsoleTail returns up to the last n lines written to the serial
+// console of an instance
+func (c *Client) ConsoleTail(name string, n int) ([]string, error) {
+	f, err := os.Open(c.ConsoleLogPath(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := st.Size() - consoleTailBytes
+	if offset < 0 {
+		offset = 0
+	}
+
+	data, err := io.ReadAll(io.NewSectionReader(f, offset, st.Size()-offset))
+	if err != nil {
+		return nil, err
+	}
+
+	// Consoles end lines with \r\n and may use \r on its own to redraw
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if offset > 0 && len(lines) > 1 {
+		lines = lines[1:] // The first line is probably cut off
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for i, line := range lines {
+		if j := strings.LastIndex(line, "\r"); j >= 0 {
+			lines[i] = line[j+1:]
+		}
+	}
+	return lines, nil
+}
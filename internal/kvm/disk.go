@@ -0,0 +1,110 @@
+package kvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/slackpass/slackpass/internal/config"
+)
+
+// diskImageInfo holds the fields of `qemu-img info --output=json` we use
+type diskImageInfo struct {
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtual-size"`
+}
+
+// createDiskImage creates a copy-on-write overlay at targetPath backed by
+// the base image at basePath, which must be absolute, and grows it to
+// size if that is larger than the base image
+func (c *Client) createDiskImage(basePath, targetPath, size string) error {
+	if basePath == "" {
+		return fmt.Errorf("no base image given")
+	}
+
+	base, err := c.diskImageInfo(basePath)
+	if err != nil {
+		return fmt.Errorf("failed to inspect base image: %w", err)
+	}
+
+	if err := c.runQEMUImg("create", "-f", "qcow2", "-b", basePath, "-F", base.Format, targetPath); err != nil {
+		return fmt.Errorf("failed to create overlay: %w", err)
+	}
+
+	if size == "" {
+		return nil
+	}
+
+	requested, err := config.ParseSize(size)
+	if err != nil {
+		return err
+	}
+	if requested <= base.VirtualSize {
+		return nil
+	}
+
+	if err := c.runQEMUImg("resize", "-f", "qcow2", targetPath, fmt.Sprintf("%d", requested)); err != nil {
+		return fmt.Errorf("failed to resize overlay: %w", err)
+	}
+
+	return nil
+}
+
+// diskImageInfo returns format and size information about a disk image
+func (c *Client) diskImageInfo(path string) (*diskImageInfo, error) {
+	output, err := exec.Command(c.config.QEMUImgBinary, "info", "--output=json", "-U", path).Output()
+	if err != nil {
+		return nil, qemuImgError(err)
+	}
+
+	var info diskImageInfo
+	if err := json.Unmarshal(output, &info); err != nil {
+		return nil, fmt.Errorf("failed to parse qemu-img output: %w", err)
+	}
+
+	return &info, nil
+}
+
+// runQEMUImg runs qemu-img with the given arguments
+func (c *Client) runQEMUImg(args ...string) error {
+	if output, err := exec.Command(c.config.QEMUImgBinary, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// baseImageInUse reports whether any instance still has an overlay backed
+// by the given base image
+func (c *Client) baseImageInUse(basePath string) bool {
+	entries, err := os.ReadDir(c.config.InstancesDir)
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		metadata, err := c.loadMetadata(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if metadata.BaseImage == basePath {
+			return true
+		}
+	}
+
+	return false
+}
+
+// qemuImgError includes the stderr output of a failed qemu-img run
+func qemuImgError(err error) error {
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err
+}
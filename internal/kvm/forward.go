@@ -0,0 +1,213 @@
+package kvm
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultForwardAddress is the host address forwards are bound on unless
+// another one is given
+const defaultForwardAddress = "127.0.0.1"
+
+// ParsePortForward parses a forward rule of the form
+// [address:]host:guest[/protocol], e.g. "8080:80" or "0.0.0.0:5353:53/udp"
+func ParsePortForward(spec string) (PortForward, error) {
+	forward := PortForward{Protocol: "tcp", Address: defaultForwardAddress}
+
+	rule, protocol, hasProtocol := strings.Cut(spec, "/")
+	if hasProtocol {
+		if protocol != "tcp" && protocol != "udp" {
+			return forward, fmt.Errorf("invalid protocol %q in %q, expected tcp or udp", protocol, spec)
+		}
+		forward.Protocol = protocol
+	}
+
+	parts := strings.Split(rule, ":")
+	switch len(parts) {
+	case 2:
+	case 3:
+		forward.Address = parts[0]
+		parts = parts[1:]
+	default:
+		return forward, fmt.Errorf("invalid forward %q, expected [address:]host:guest[/protocol]", spec)
+	}
+
+	var err error
+	if forward.HostPort, err = parsePort(parts[0]); err != nil {
+		return forward, fmt.Errorf("invalid host port in %q: %w", spec, err)
+	}
+	if forward.GuestPort, err = parsePort(parts[1]); err != nil {
+		return forward, fmt.Errorf("invalid guest port in %q: %w", spec, err)
+	}
+
+	return forward, nil
+}
+
+// String formats a forward the way ParsePortForward reads it
+func (f PortForward) String() string {
+	return fmt.Sprintf("%s:%d:%d/%s", f.Address, f.HostPort, f.GuestPort, f.Protocol)
+}
+
+// hostfwd returns the rule in the form used by hostfwd and hostfwd_add
+func (f PortForward) hostfwd() string {
+	return fmt.Sprintf("%s:%s:%d-:%d", f.Protocol, f.Address, f.HostPort, f.GuestPort)
+}
+
+// Forwards returns the port forwards of an instance
+func (c *Client) Forwards(name string) ([]PortForward, error) {
+	metadata, err := c.loadMetadata(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	return metadata.Forwards, nil
+}
+
+// AddForward adds a port forward to an instance. It is applied right away
+// when the instance is running and at every start.
+func (c *Client) AddForward(name string, forward PortForward) error {
+	metadata, err := c.getMetadata(name)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	if metadata.Network == NetworkBridge {
+		return fmt.Errorf("instance '%s' is bridged and reachable on its own address", name)
+	}
+
+	unlock, err := c.lockPorts()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	forwards := append(append([]PortForward{}, metadata.Forwards...), forward)
+	if err := c.ValidateForwards(name, forwards); err != nil {
+		return err
+	}
+	if forward.Protocol == "tcp" && forward.HostPort == metadata.SSHPort {
+		return fmt.Errorf("host port %d is used for SSH", forward.HostPort)
+	}
+
+	switch VMState(metadata.State) {
+	case StateRunning:
+		if err := c.humanMonitorCommand(name, "hostfwd_add net0 "+forward.hostfwd()); err != nil {
+			return fmt.Errorf("failed to add forward: %w", err)
+		}
+	case StateStopped, StateSuspended:
+	default:
+		return fmt.Errorf("cannot add forwards to '%s' while it is %s", name, metadata.State)
+	}
+
+	metadata.Forwards = forwards
+	metadataPath := filepath.Join(c.config.InstancesDir, name, "metadata.json")
+	return c.saveMetadata(metadata, metadataPath)
+}
+
+// RemoveForward removes the forward of a host port, given as
+// port[/protocol], from an instance
+func (c *Client) RemoveForward(name, hostPort string) error {
+	metadata, err := c.getMetadata(name)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	portSpec, protocol, hasProtocol := strings.Cut(hostPort, "/")
+	if !hasProtocol {
+		protocol = "tcp"
+	}
+	port, err := parsePort(portSpec)
+	if err != nil {
+		return fmt.Errorf("invalid host port %q: %w", hostPort, err)
+	}
+
+	i := -1
+	for j, forward := range metadata.Forwards {
+		if forward.Protocol == protocol && forward.HostPort == port {
+			i = j
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("no forward of %s port %d on '%s'", protocol, port, name)
+	}
+	forward := metadata.Forwards[i]
+
+	switch VMState(metadata.State) {
+	case StateRunning:
+		rule := fmt.Sprintf("hostfwd_remove net0 %s:%s:%d", forward.Protocol, forward.Address, forward.HostPort)
+		if err := c.humanMonitorCommand(name, rule); err != nil {
+			return fmt.Errorf("failed to remove forward: %w", err)
+		}
+	case StateStopped, StateSuspended:
+	default:
+		return fmt.Errorf("cannot remove forwards from '%s' while it is %s", name, metadata.State)
+	}
+
+	metadata.Forwards = append(metadata.Forwards[:i], metadata.Forwards[i+1:]...)
+	metadataPath := filepath.Join(c.config.InstancesDir, name, "metadata.json")
+	return c.saveMetadata(metadata, metadataPath)
+}
+
+// ValidateForwards checks that the forwards of an instance do not use a
+// host port twice or a host port recorded by another instance
+func (c *Client) ValidateForwards(name string, forwards []PortForward) error {
+	reserved := c.reservedPorts(name)
+	seen := make(map[string]bool)
+
+	for _, forward := range forwards {
+		key := portKey(forward.Protocol, forward.HostPort)
+		if seen[key] {
+			return fmt.Errorf("%s host port %d is forwarded twice", forward.Protocol, forward.HostPort)
+		}
+		if reserved[key] {
+			return fmt.Errorf("%s host port %d is used by another instance", forward.Protocol, forward.HostPort)
+		}
+		seen[key] = true
+	}
+
+	return nil
+}
+
+// checkForwards makes sure every forward of an instance can be bound
+// before QEMU is started. Callers must hold the port lock.
+func (c *Client) checkForwards(metadata *InstanceMetadata) error {
+	if err := c.ValidateForwards(metadata.Name, metadata.Forwards); err != nil {
+		return err
+	}
+
+	for _, forward := range metadata.Forwards {
+		if !hostPortFree(forward.Protocol, forward.Address, forward.HostPort) {
+			return fmt.Errorf("%s host port %d is already in use", forward.Protocol, forward.HostPort)
+		}
+	}
+
+	return nil
+}
+
+// humanMonitorCommand runs a monitor command that has no QMP equivalent.
+// Such commands report errors as output rather than as a QMP error.
+func (c *Client) humanMonitorCommand(name, command string) error {
+	monitor, err := c.connectQMP(name)
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+
+	var output string
+	if err := monitor.Run("human-monitor-command", map[string]string{"command-line": command}, &output); err != nil {
+		return err
+	}
+	if output = strings.TrimSpace(output); output != "" {
+		return fmt.Errorf("%s", output)
+	}
+	return nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("%q is not a port number", s)
+	}
+	return port, nil
+}
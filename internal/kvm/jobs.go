@@ -0,0 +1,68 @@
+package kvm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/slackpass/slackpass/internal/qmp"
+)
+
+const (
+	// jobTimeout bounds long running QMP jobs such as saving RAM state
+	jobTimeout = 10 * time.Minute
+
+	jobPollInterval = 200 * time.Millisecond
+)
+
+// diskNodeName is the block node name of an instance's disk, used by QMP
+// commands that take node names
+const diskNodeName = "disk0"
+
+// diskDeviceID is the drive id of an instance's disk
+const diskDeviceID = "drive0"
+
+// jobInfo is an entry of QMP query-jobs
+type jobInfo struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// runJob starts a QMP job command and waits for the job to conclude
+func runJob(monitor *qmp.Client, command, jobID string, args map[string]interface{}) error {
+	args["job-id"] = jobID
+	if _, err := monitor.Execute(command, args); err != nil {
+		return fmt.Errorf("%s failed: %w", command, err)
+	}
+
+	deadline := time.Now().Add(jobTimeout)
+	for {
+		var jobs []jobInfo
+		if err := monitor.Run("query-jobs", nil, &jobs); err != nil {
+			return err
+		}
+
+		var job *jobInfo
+		for i := range jobs {
+			if jobs[i].ID == jobID {
+				job = &jobs[i]
+			}
+		}
+		if job == nil {
+			return fmt.Errorf("job %s disappeared", jobID)
+		}
+
+		if job.Status == "concluded" {
+			monitor.Execute("job-dismiss", map[string]string{"id": jobID})
+			if job.Error != "" {
+				return fmt.Errorf("%s failed: %s", command, job.Error)
+			}
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s", command)
+		}
+		time.Sleep(jobPollInterval)
+	}
+}
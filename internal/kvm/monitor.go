@@ -0,0 +1,109 @@
+package kvm
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/slackpass/slackpass/internal/qmp"
+)
+
+const (
+	// qmpDialTimeout bounds connecting to and greeting a QMP socket, and
+	// each command sent over it; long operations run as jobs instead
+	qmpDialTimeout = 5 * time.Second
+
+	// shutdownTimeout is how long a guest gets to power off cleanly
+	shutdownTimeout = 60 * time.Second
+
+	// agentTimeout bounds each guest agent command
+	agentTimeout = 2 * time.Second
+)
+
+// agentChardevID is the id of the chardev the guest agent channel uses
+const agentChardevID = "qga"
+
+// qmpSocketPath returns the path of the QMP socket of an instance
+func (c *Client) qmpSocketPath(name string) string {
+	return filepath.Join(c.config.InstancesDir, name, "qmp.sock")
+}
+
+// agentSocketPath returns the path of the guest agent socket of an instance
+func (c *Client) agentSocketPath(name string) string {
+	return filepath.Join(c.config.InstancesDir, name, "qga.sock")
+}
+
+// connectAgent opens a connection to the guest agent of a running
+// instance. It fails quickly when no agent is listening in the guest.
+func (c *Client) connectAgent(name string) (*qmp.Agent, error) {
+	monitor, err := c.connectQMP(name)
+	if err != nil {
+		return nil, err
+	}
+	defer monitor.Close()
+
+	// The guest opens its end of the channel once the agent is running
+	var chardevs []struct {
+		Label        string `json:"label"`
+		FrontendOpen bool   `json:"frontend-open"`
+	}
+	if err := monitor.Run("query-chardev", nil, &chardevs); err != nil {
+		return nil, err
+	}
+	open := false
+	for _, chardev := range chardevs {
+		if chardev.Label == agentChardevID {
+			open = chardev.FrontendOpen
+		}
+	}
+	if !open {
+		return nil, fmt.Errorf("guest agent of '%s' is not running", name)
+	}
+
+	agent, err := qmp.DialAgent(c.agentSocketPath(name), agentTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to guest agent of '%s': %w", name, err)
+	}
+	return agent, nil
+}
+
+// connectQMP opens a QMP connection to a running instance
+func (c *Client) connectQMP(name string) (*qmp.Client, error) {
+	monitor, err := qmp.Dial(c.qmpSocketPath(name), qmpDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to QMP socket of '%s': %w", name, err)
+	}
+	return monitor, nil
+}
+
+// powerdown asks the guest to shut down and waits until it has
+func (c *Client) powerdown(name string) error {
+	monitor, err := c.connectQMP(name)
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+
+	if _, err := monitor.Execute("system_powerdown", nil); err != nil {
+		return fmt.Errorf("system_powerdown failed: %w", err)
+	}
+
+	if _, err := monitor.WaitForEvent("SHUTDOWN", shutdownTimeout); err != nil {
+		return fmt.Errorf("guest did not shut down, use --force to stop it: %w", err)
+	}
+
+	return nil
+}
+
+// quit terminates QEMU immediately
+func (c *Client) quit(name string) error {
+	monitor, err := c.connectQMP(name)
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+
+	// QEMU may close the socket before answering, which is fine
+	monitor.Execute("quit", nil)
+	return nil
+}
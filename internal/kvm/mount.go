@@ -0,0 +1,403 @@
+package kvm
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Mount types
+const (
+	MountVirtiofs = "virtiofs"
+	Mount9p       = "9p"
+)
+
+const (
+	// memoryBackendID is the id of the shared memory backend vhost-user
+	// devices such as virtiofs need
+	memoryBackendID = "mem"
+
+	// virtiofsdStartTimeout is how long virtiofsd gets to create its socket
+	virtiofsdStartTimeout = 5 * time.Second
+
+	// deviceRemoveTimeout is how long the guest gets to release a device
+	deviceRemoveTimeout = 10 * time.Second
+)
+
+// Mounts returns the directories shared with an instance
+func (c *Client) Mounts(name string) ([]Mount, error) {
+	metadata, err := c.loadMetadata(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	return metadata.Mounts, nil
+}
+
+// NewMount checks a host directory and guest path and returns a mount
+// of the type this host supports. The tag is assigned when the mount is
+// added to an instance.
+func (c *Client) NewMount(source, target string) (Mount, error) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return Mount{}, err
+	}
+	st, err := os.Stat(source)
+	if err != nil {
+		return Mount{}, err
+	}
+	if !st.IsDir() {
+		return Mount{}, fmt.Errorf("%s is not a directory", source)
+	}
+
+	if target == "" {
+		target = source
+	}
+	if !strings.HasPrefix(target, "/") {
+		return Mount{}, fmt.Errorf("guest path %s is not absolute", target)
+	}
+
+	mountType := Mount9p
+	if c.config.VirtiofsdBinary != "" {
+		mountType = MountVirtiofs
+	}
+
+	return Mount{Source: source, Target: filepath.Clean(target), Type: mountType}, nil
+}
+
+// AddMount shares a host directory with an instance. A running instance
+// gets the share hot-plugged, which is only possible with virtiofs; the
+// guest side of the mount is left to the caller.
+func (c *Client) AddMount(name string, mount Mount) (*Mount, error) {
+	metadata, err := c.getMetadata(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	for _, m := range metadata.Mounts {
+		if m.Target == mount.Target {
+			return nil, fmt.Errorf("%s is already mounted on '%s'", mount.Target, name)
+		}
+	}
+	mount.Tag = nextMountTag(metadata.Mounts)
+
+	switch VMState(metadata.State) {
+	case StateRunning:
+		if mount.Type != MountVirtiofs {
+			return nil, fmt.Errorf("'%s' must be stopped to add a 9p mount, virtiofsd is not installed", name)
+		}
+		shared, err := c.hasSharedMemory(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect the memory of '%s': %w", name, err)
+		}
+		if !shared {
+			return nil, fmt.Errorf("'%s' was started without shared directories and must be stopped to add one", name)
+		}
+		if err := c.attachVirtiofs(metadata, mount); err != nil {
+			return nil, fmt.Errorf("failed to attach mount: %w", err)
+		}
+	case StateStopped:
+	default:
+		return nil, fmt.Errorf("cannot mount into '%s' while it is %s", name, metadata.State)
+	}
+
+	metadata.Mounts = append(metadata.Mounts, mount)
+	metadataPath := filepath.Join(c.config.InstancesDir, name, "metadata.json")
+	if err := c.saveMetadata(metadata, metadataPath); err != nil {
+		return nil, err
+	}
+
+	return &mount, nil
+}
+
+// RemoveMount stops sharing the directory mounted on target with an
+// instance. The guest must have unmounted it already.
+func (c *Client) RemoveMount(name, target string) error {
+	metadata, err := c.getMetadata(name)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	i := -1
+	for j, m := range metadata.Mounts {
+		if m.Target == filepath.Clean(target) {
+			i = j
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("nothing is mounted on %s in '%s'", target, name)
+	}
+	mount := metadata.Mounts[i]
+
+	switch VMState(metadata.State) {
+	case StateRunning:
+		// A 9p device cannot be unplugged and stays until the next restart
+		if mount.Type == MountVirtiofs {
+			if err := c.detachVirtiofs(name, mount); err != nil {
+				return fmt.Errorf("failed to detach mount: %w", err)
+			}
+		}
+	case StateStopped:
+	default:
+		return fmt.Errorf("cannot unmount from '%s' while it is %s", name, metadata.State)
+	}
+
+	metadata.Mounts = append(metadata.Mounts[:i], metadata.Mounts[i+1:]...)
+	metadataPath := filepath.Join(c.config.InstancesDir, name, "metadata.json")
+	return c.saveMetadata(metadata, metadataPath)
+}
+
+// checkMigratable fails when an instance has shared directories, because
+// QEMU cannot save the state of a running guest with virtiofs or mounted
+// 9p devices, which suspend and live snapshots rely on
+func checkMigratable(metadata *InstanceMetadata, action string) error {
+	if len(metadata.Mounts) > 0 {
+		return fmt.Errorf("cannot %s '%s' while it has shared directories, unmount them first "+
+			"or stop the instance", action, metadata.Name)
+	}
+	return nil
+}
+
+// sharedMemory reports whether an instance is started with guest memory
+// that vhost-user devices can share, which virtiofs needs. Only instances
+// with virtiofs mounts get it, since it changes the memory layout.
+func sharedMemory(metadata *InstanceMetadata) bool {
+	for _, mount := range metadata.Mounts {
+		if mount.Type == MountVirtiofs {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSharedMemory reports whether a running instance was started with
+// the shared memory backend, so virtiofs mounts can be hot-plugged
+func (c *Client) hasSharedMemory(name string) (bool, error) {
+	monitor, err := c.connectQMP(name)
+	if err != nil {
+		return false, err
+	}
+	defer monitor.Close()
+
+	var memdevs []struct {
+		ID    string `json:"id"`
+		Share bool   `json:"share"`
+	}
+	if err := monitor.Run("query-memdev", nil, &memdevs); err != nil {
+		return false, fmt.Errorf("query-memdev failed: %w", err)
+	}
+	for _, memdev := range memdevs {
+		if memdev.ID == memoryBackendID && memdev.Share {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mountArgs returns the QEMU options for the mounts of an instance
+func (c *Client) mountArgs(metadata *InstanceMetadata) []string {
+	var args []string
+
+	if sharedMemory(metadata) {
+		// The backend must be exactly as large as the RAM given with -m
+		args = append(args,
+			"-object", fmt.Sprintf("memory-backend-memfd,id=%s,size=%s,share=on", memoryBackendID, metadata.Memory),
+			"-numa", "node,memdev="+memoryBackendID,
+		)
+	}
+
+	for _, mount := range metadata.Mounts {
+		switch mount.Type {
+		case MountVirtiofs:
+			args = append(args,
+				"-chardev", fmt.Sprintf("socket,id=%s,path=%s", mount.Tag, c.virtiofsSocketPath(metadata.Name, mount)),
+				"-device", fmt.Sprintf("vhost-user-fs-pci,id=%s,chardev=%s,tag=%s", mount.Tag, mount.Tag, mount.Tag),
+			)
+		case Mount9p:
+			args = append(args, "-virtfs", fmt.Sprintf("local,path=%s,mount_tag=%s,security_model=none,id=%s",
+				escapeOption(mount.Source), mount.Tag, mount.Tag))
+		}
+	}
+
+	return args
+}
+
+// startVirtiofsd starts a virtiofsd for every virtiofs mount of an
+// instance ahead of QEMU, which connects to their sockets. The returned
+// function stops them again if QEMU fails to start; otherwise each
+// daemon exits on its own when QEMU disconnects.
+func (c *Client) startVirtiofsd(metadata *InstanceMetadata) (func(), error) {
+	var started []*os.Process
+	stop := func() {
+		for _, process := range started {
+			process.Kill()
+		}
+	}
+
+	for _, mount := range metadata.Mounts {
+		if mount.Type != MountVirtiofs {
+			continue
+		}
+		if c.config.VirtiofsdBinary == "" {
+			stop()
+			return nil, fmt.Errorf("virtiofsd is needed to mount %s but is not installed", mount.Source)
+		}
+
+		process, err := c.runVirtiofsd(metadata.Name, mount)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("failed to start virtiofsd for %s: %w", mount.Source, err)
+		}
+		started = append(started, process)
+	}
+
+	return stop, nil
+}
+
+// runVirtiofsd starts a detached virtiofsd serving one mount and waits
+// for its socket to appear
+func (c *Client) runVirtiofsd(name string, mount Mount) (*os.Process, error) {
+	socketPath := c.virtiofsSocketPath(name, mount)
+	os.Remove(socketPath)
+
+	args := []string{
+		"--socket-path=" + socketPath,
+		"--shared-dir=" + mount.Source,
+		"--cache=auto",
+	}
+	// The namespace sandbox needs privileges a normal user lacks
+	if os.Geteuid() != 0 {
+		args = append(args, "--sandbox=none")
+	}
+
+	logPath := filepath.Join(c.config.InstancesDir, name, "virtiofsd-"+mount.Tag+".log")
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(c.config.VirtiofsdBinary, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	deadline := time.Now().Add(virtiofsdStartTimeout)
+	for {
+		if _, err := os.Stat(socketPath); err == nil {
+			return cmd.Process, nil
+		}
+
+		select {
+		case err := <-exited:
+			return nil, fmt.Errorf("virtiofsd exited: %v, see %s", err, logPath)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if time.Now().After(deadline) {
+			cmd.Process.Kill()
+			return nil, fmt.Errorf("timed out waiting for %s", socketPath)
+		}
+	}
+}
+
+// attachVirtiofs hot-plugs a virtiofs mount into a running instance
+func (c *Client) attachVirtiofs(metadata *InstanceMetadata, mount Mount) error {
+	process, err := c.runVirtiofsd(metadata.Name, mount)
+	if err != nil {
+		return fmt.Errorf("failed to start virtiofsd: %w", err)
+	}
+
+	monitor, err := c.connectQMP(metadata.Name)
+	if err != nil {
+		process.Kill()
+		return err
+	}
+	defer monitor.Close()
+
+	chardev := map[string]interface{}{
+		"id": mount.Tag,
+		"backend": map[string]interface{}{
+			"type": "socket",
+			"data": map[string]interface{}{
+				"addr": map[string]interface{}{
+					"type": "unix",
+					"data": map[string]string{"path": c.virtiofsSocketPath(metadata.Name, mount)},
+				},
+				"server": false,
+			},
+		},
+	}
+	if _, err := monitor.Execute("chardev-add", chardev); err != nil {
+		process.Kill()
+		return fmt.Errorf("chardev-add failed: %w", err)
+	}
+
+	device := map[string]string{
+		"driver":  "vhost-user-fs-pci",
+		"id":      mount.Tag,
+		"chardev": mount.Tag,
+		"tag":     mount.Tag,
+	}
+	if _, err := monitor.Execute("device_add", device); err != nil {
+		monitor.Execute("chardev-remove", map[string]string{"id": mount.Tag})
+		process.Kill()
+		return fmt.Errorf("device_add failed: %w", err)
+	}
+
+	return nil
+}
+
+// detachVirtiofs unplugs a virtiofs mount from a running instance. Its
+// virtiofsd exits once the device is gone.
+func (c *Client) detachVirtiofs(name string, mount Mount) error {
+	monitor, err := c.connectQMP(name)
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+
+	if _, err := monitor.Execute("device_del", map[string]string{"id": mount.Tag}); err != nil {
+		return fmt.Errorf("device_del failed: %w", err)
+	}
+	if _, err := monitor.WaitForEvent("DEVICE_DELETED", deviceRemoveTimeout); err != nil {
+		return err
+	}
+
+	if _, err := monitor.Execute("chardev-remove", map[string]string{"id": mount.Tag}); err != nil {
+		return fmt.Errorf("chardev-remove failed: %w", err)
+	}
+	return nil
+}
+
+// virtiofsSocketPath returns the path of the vhost-user socket of a mount
+func (c *Client) virtiofsSocketPath(name string, mount Mount) string {
+	return filepath.Join(c.config.InstancesDir, name, "virtiofs-"+mount.Tag+".sock")
+}
+
+// nextMountTag returns the first "mountN" tag not used by mounts
+func nextMountTag(mounts []Mount) string {
+	used := make(map[string]bool, len(mounts))
+	for _, mount := range mounts {
+		used[mount.Tag] = true
+	}
+	for i := 0; ; i++ {
+		if tag := fmt.Sprintf("mount%d", i); !used[tag] {
+			return tag
+		}
+	}
+}
+
+// escapeOption escapes commas in a value of a QEMU option list
+func escapeOption(value string) string {
+	return strings.ReplaceAll(value, ",", ",,")
+}
@@ -0,0 +1,104 @@
+package kvm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/slackpass/slackpass/internal/config"
+)
+
+// argValues returns the values given to a QEMU option
+func argValues(args []string, option string) []string {
+	var values []string
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == option {
+			values = append(values, args[i+1])
+		}
+	}
+	return values
+}
+
+func TestNormalizeMemory(t *testing.T) {
+	tests := map[string]string{
+		"2048":     "2048M",
+		"1.5":      "1.5M",
+		"2G":       "2G",
+		"2g":       "2G",
+		"512MiB":   "512M",
+		"4GB":      "4G",
+		"2Gi":      "2G",
+		"1048576B": "1048576B",
+	}
+	for size, want := range tests {
+		got, err := NormalizeMemory(size)
+		if err != nil {
+			t.Errorf("NormalizeMemory(%q): %v", size, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("NormalizeMemory(%q) = %q, want %q", size, got, want)
+		}
+	}
+
+	for _, size := range []string{"", "lots", "-1", "0"} {
+		if _, err := NormalizeMemory(size); err == nil {
+			t.Errorf("NormalizeMemory(%q) succeeded, want an error", size)
+		}
+	}
+}
+
+func TestSharedMemoryMatchesRAM(t *testing.T) {
+	c := NewClient(&config.Config{
+		InstancesDir:    t.TempDir(),
+		QEMUBinary:      "qemu-system-x86_64",
+		VirtiofsdBinary: "/usr/libexec/virtiofsd",
+	})
+
+	memory, err := NormalizeMemory("2048")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := &InstanceMetadata{
+		Name:    "test",
+		CPUs:    1,
+		Memory:  memory,
+		SSHPort: 2222,
+		Mounts:  []Mount{{Source: "/src", Target: "/src", Type: MountVirtiofs, Tag: "mount0"}},
+	}
+
+	args := c.buildQEMUCommand(metadata).Args
+	if got := argValues(args, "-m"); len(got) != 1 || got[0] != "2048M" {
+		t.Fatalf("got -m %v, want 2048M", got)
+	}
+
+	objects := argValues(args, "-object")
+	if len(objects) != 1 || !strings.Contains(objects[0], "memory-backend-memfd") ||
+		!strings.Contains(objects[0], ",size=2048M,") {
+		t.Errorf("got -object %v, want a 2048M memfd backend", objects)
+	}
+	if got := argValues(args, "-numa"); len(got) != 1 || got[0] != "node,memdev="+memoryBackendID {
+		t.Errorf("got -numa %v", got)
+	}
+}
+
+func TestNoSharedMemoryWithoutVirtiofs(t *testing.T) {
+	c := NewClient(&config.Config{
+		InstancesDir:    t.TempDir(),
+		QEMUBinary:      "qemu-system-x86_64",
+		VirtiofsdBinary: "/usr/libexec/virtiofsd",
+	})
+
+	for _, mounts := range [][]Mount{
+		nil,
+		{{Source: "/src", Target: "/src", Type: Mount9p, Tag: "mount0"}},
+	} {
+		metadata := &InstanceMetadata{Name: "test", CPUs: 1, Memory: "1G", SSHPort: 2222, Mounts: mounts}
+		args := c.buildQEMUCommand(metadata).Args
+		if got := argValues(args, "-object"); len(got) != 0 {
+			t.Errorf("mounts %v: got -object %v, want none", mounts, got)
+		}
+		if got := argValues(args, "-numa"); len(got) != 0 {
+			t.Errorf("mounts %v: got -numa %v, want none", mounts, got)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package kvm
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Network modes of an instance
+const (
+	// NetworkUser is user-mode (SLIRP) networking with SSH forwarded from
+	// a port on the host's loopback address
+	NetworkUser = "user"
+
+	// NetworkBridge attaches a TAP device to a host bridge through
+	// qemu-bridge-helper, giving the guest its own address
+	NetworkBridge = "bridge"
+)
+
+// arpFlagComplete marks a resolved entry in /proc/net/arp
+const arpFlagComplete = "0x2"
+
+// slirpGuestAddress is the address QEMU's user-mode DHCP server hands to
+// the first, and only, guest on the network
+const slirpGuestAddress = "10.0.2.15"
+
+// guestInterface is an entry of guest-network-get-interfaces
+type guestInterface struct {
+	Name            string `json:"name"`
+	HardwareAddress string `json:"hardware-address"`
+	IPAddresses     []struct {
+		Type    string `json:"ip-address-type"`
+		Address string `json:"ip-address"`
+	} `json:"ip-addresses"`
+}
+
+// netdev returns the -netdev option for the network mode of an instance
+func (c *Client) netdev(metadata *InstanceMetadata) string {
+	if metadata.Network == NetworkBridge {
+		return fmt.Sprintf("bridge,id=net0,br=%s", metadata.Bridge)
+	}
+
+	netdev := fmt.Sprintf("user,id=net0,hostfwd=tcp:127.0.0.1:%d-:%d", metadata.SSHPort, c.config.SSHPort)
+	for _, forward := range metadata.Forwards {
+		netdev += ",hostfwd=" + forward.hostfwd()
+	}
+	return netdev
+}
+
+// netDevice returns the -device option of the network interface, keeping
+// the MAC address of the instance stable across restarts
+func netDevice(metadata *InstanceMetadata) string {
+	if metadata.MAC == "" {
+		return "virtio-net-pci,netdev=net0"
+	}
+	return "virtio-net-pci,netdev=net0,mac=" + metadata.MAC
+}
+
+// discoverAddress works out the IPv4 address of an instance in the given
+// state from the best source available: the guest agent when agent is
+// set, then for bridged instances the DHCP leases of the bridge and the
+// ARP table, and for user-mode networking the fixed SLIRP address.
+// Instances that are not running have no address.
+func (c *Client) discoverAddress(metadata *InstanceMetadata, state VMState, agent bool) string {
+	if state != StateRunning {
+		return ""
+	}
+
+	if agent {
+		if ip := c.agentAddress(metadata); ip != "" {
+			return ip
+		}
+	}
+
+	if metadata.Network == NetworkBridge {
+		if ip := leaseAddress(c.config.BridgeLeases, metadata.MAC); ip != "" {
+			return ip
+		}
+		if ip := neighborAddress(metadata.MAC); ip != "" {
+			return ip
+		}
+		return metadata.IPv4
+	}
+
+	// Keep an address learned from the guest agent
+	if metadata.IPv4 != "" {
+		return metadata.IPv4
+	}
+	return slirpGuestAddress
+}
+
+// refreshAddress updates the cached address of a running instance,
+// asking the guest agent first
+func (c *Client) refreshAddress(metadata *InstanceMetadata) {
+	ip := c.discoverAddress(metadata, VMState(metadata.State), true)
+	if ip == metadata.IPv4 {
+		return
+	}
+
+	metadata.IPv4 = ip
+	metadataPath := filepath.Join(c.config.InstancesDir, metadata.Name, "metadata.json")
+	c.saveMetadata(metadata, metadataPath)
+}
+
+// agentAddress asks the guest agent for the IPv4 address of the
+// interface with the instance's MAC address, or of the first interface
+// that is not a loopback if none matches
+func (c *Client) agentAddress(metadata *InstanceMetadata) string {
+	agent, err := c.connectAgent(metadata.Name)
+	if err != nil {
+		return ""
+	}
+	defer agent.Close()
+
+	var interfaces []guestInterface
+	if err := agent.Run("guest-network-get-interfaces", nil, &interfaces); err != nil {
+		return ""
+	}
+
+	fallback := ""
+	for _, iface := range interfaces {
+		for _, addr := range iface.IPAddresses {
+			ip := net.ParseIP(addr.Address)
+			if addr.Type != "ipv4" || ip == nil || ip.IsLoopback() {
+				continue
+			}
+			if metadata.MAC != "" && strings.EqualFold(iface.HardwareAddress, metadata.MAC) {
+				return addr.Address
+			}
+			if fallback == "" {
+				fallback = addr.Address
+			}
+		}
+	}
+
+	return fallback
+}
+
+// leaseAddress looks up the address leased to a MAC address in a dnsmasq
+// leases file, preferring the lease that expires last
+func leaseAddress(leasesPath, mac string) string {
+	if mac == "" || leasesPath == "" {
+		return ""
+	}
+
+	f, err := os.Open(leasesPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	address, latest := "", int64(-1)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Expiry time, MAC address, IP address, hostname, client id
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || !strings.EqualFold(fields[1], mac) {
+			continue
+		}
+		if net.ParseIP(fields[2]).To4() == nil {
+			continue
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		// An expiry of 0 means the lease never expires
+		if expiry == 0 {
+			expiry = math.MaxInt64
+		}
+		if expiry > latest {
+			address, latest = fields[2], expiry
+		}
+	}
+
+	return address
+}
+
+// neighborAddress looks up the IPv4 address of a MAC address in the
+// kernel's ARP table
+func neighborAddress(mac string) string {
+	if mac == "" {
+		return ""
+	}
+
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Skip the header
+	for scanner.Scan() {
+		// IP address, HW type, Flags, HW address, Mask, Device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		if fields[2] == arpFlagComplete && strings.EqualFold(fields[3], mac) {
+			return fields[0]
+		}
+	}
+
+	return ""
+}
+
+// generateMAC returns a random MAC address in the QEMU/KVM 52:54:00 range
+func generateMAC() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", b[0], b[1], b[2])
+}
@@ -0,0 +1,131 @@
+package kvm
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Host ports SSH forwards are allocated from
+const (
+	sshPortRangeStart = 2222
+	sshPortRangeEnd   = 3222
+)
+
+// lockPorts takes an exclusive lock that serializes port allocation
+// between concurrent slackpass processes. The returned function releases
+// it.
+func (c *Client) lockPorts() (func(), error) {
+	lockPath := filepath.Join(c.config.DataDir, "ports.lock")
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open port lock: %w", err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock ports: %w", err)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// allocateSSHPort picks a free host port for the SSH forward of an
+// instance. The previously used port is preferred, otherwise the search
+// starts at a position derived from the instance name so that an
+// instance tends to keep the same port. Ports recorded by other instances
+// are never handed out. Callers must hold the port lock.
+func (c *Client) allocateSSHPort(metadata *InstanceMetadata) (int, error) {
+	reserved := c.reservedPorts(metadata.Name)
+
+	// Never collide with the instance's own forwards either
+	for _, forward := range metadata.Forwards {
+		reserved[portKey(forward.Protocol, forward.HostPort)] = true
+	}
+
+	if port := metadata.SSHPort; port != 0 && !reserved[portKey("tcp", port)] && portFree(port) {
+		return port, nil
+	}
+
+	size := sshPortRangeEnd - sshPortRangeStart + 1
+	h := fnv.New32a()
+	h.Write([]byte(metadata.Name))
+	offset := int(h.Sum32() % uint32(size))
+
+	for i := 0; i < size; i++ {
+		port := sshPortRangeStart + (offset+i)%size
+		if reserved[portKey("tcp", port)] || !portFree(port) {
+			continue
+		}
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("no free port between %d and %d", sshPortRangeStart, sshPortRangeEnd)
+}
+
+// reservedPorts returns the host ports recorded by all instances except
+// the named one, for SSH and for port forwards, keyed by portKey
+func (c *Client) reservedPorts(except string) map[string]bool {
+	reserved := make(map[string]bool)
+
+	entries, err := os.ReadDir(c.config.InstancesDir)
+	if err != nil {
+		return reserved
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == except {
+			continue
+		}
+
+		metadata, err := c.loadMetadata(entry.Name())
+		if err != nil {
+			continue
+		}
+		if metadata.SSHPort != 0 {
+			reserved[portKey("tcp", metadata.SSHPort)] = true
+		}
+		for _, forward := range metadata.Forwards {
+			reserved[portKey(forward.Protocol, forward.HostPort)] = true
+		}
+	}
+
+	return reserved
+}
+
+// portKey identifies a host port of a protocol
+func portKey(protocol string, port int) string {
+	return fmt.Sprintf("%s/%d", protocol, port)
+}
+
+// portFree reports whether a TCP port can be bound on the loopback address
+func portFree(port int) bool {
+	return hostPortFree("tcp", "127.0.0.1", port)
+}
+
+// hostPortFree reports whether a TCP or UDP port can be bound on address
+func hostPortFree(protocol, address string, port int) bool {
+	hostPort := net.JoinHostPort(address, strconv.Itoa(port))
+	if protocol == "udp" {
+		conn, err := net.ListenPacket("udp", hostPort)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	l, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
@@ -0,0 +1,243 @@
+package kvm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// snapshotNamePattern restricts snapshot names to something that is safe
+// as a qcow2 tag and a command line argument
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Snapshot takes a named snapshot of an instance. A stopped instance is
+// snapshotted with qemu-img, a running one with a QMP snapshot-save job
+// that includes the RAM state. An empty snapshot name picks the next
+// free "snapshotN".
+func (c *Client) Snapshot(name, snapshot, comment string) (*Snapshot, error) {
+	metadata, err := c.getMetadata(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	snapshots, err := c.loadSnapshots(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshot == "" {
+		snapshot = nextSnapshotName(snapshots)
+	}
+	if !snapshotNamePattern.MatchString(snapshot) {
+		return nil, fmt.Errorf("invalid snapshot name: %q", snapshot)
+	}
+	if findSnapshot(snapshots, snapshot) >= 0 {
+		return nil, fmt.Errorf("snapshot '%s' already exists for '%s'", snapshot, name)
+	}
+
+	record := &Snapshot{
+		Name:      snapshot,
+		Comment:   comment,
+		CreatedAt: time.Now(),
+		Metadata:  *metadata,
+	}
+
+	switch VMState(metadata.State) {
+	case StateStopped:
+		if err := c.runQEMUImg("snapshot", "-c", snapshot, metadata.DiskPath); err != nil {
+			return nil, fmt.Errorf("failed to create snapshot: %w", err)
+		}
+	case StateRunning:
+		if err := checkMigratable(metadata, "snapshot"); err != nil {
+			return nil, err
+		}
+		if err := c.liveSnapshot(name, "snapshot-save", snapshot); err != nil {
+			return nil, fmt.Errorf("failed to create snapshot: %w", err)
+		}
+		record.Live = true
+	default:
+		return nil, fmt.Errorf("cannot snapshot '%s' while it is %s", name, metadata.State)
+	}
+
+	snapshots = append(snapshots, record)
+	if err := c.saveSnapshots(name, snapshots); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// Restore reverts an instance to a snapshot, bringing back the CPU,
+// memory and disk configuration recorded with it. A running instance
+// also gets its RAM state restored, which requires the configuration to
+// be unchanged since the snapshot.
+func (c *Client) Restore(name, snapshot string) error {
+	metadata, err := c.getMetadata(name)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	snapshots, err := c.loadSnapshots(name)
+	if err != nil {
+		return err
+	}
+
+	i := findSnapshot(snapshots, snapshot)
+	if i < 0 {
+		return fmt.Errorf("snapshot '%s' not found for '%s'", snapshot, name)
+	}
+	record := snapshots[i]
+
+	switch VMState(metadata.State) {
+	case StateStopped:
+		if err := c.runQEMUImg("snapshot", "-a", snapshot, metadata.DiskPath); err != nil {
+			return fmt.Errorf("failed to restore snapshot: %w", err)
+		}
+	case StateRunning:
+		if !record.Live {
+			return fmt.Errorf("snapshot '%s' has no RAM state, stop '%s' to restore it", snapshot, name)
+		}
+		if record.Metadata.CPUs != metadata.CPUs || record.Metadata.Memory != metadata.Memory {
+			return fmt.Errorf("configuration of '%s' changed since snapshot '%s', stop it to restore", name, snapshot)
+		}
+		if err := checkMigratable(metadata, "restore"); err != nil {
+			return err
+		}
+		if err := c.liveSnapshot(name, "snapshot-load", snapshot); err != nil {
+			return fmt.Errorf("failed to restore snapshot: %w", err)
+		}
+	default:
+		return fmt.Errorf("cannot restore '%s' while it is %s", name, metadata.State)
+	}
+
+	metadata.CPUs = record.Metadata.CPUs
+	metadata.Memory = record.Metadata.Memory
+	metadata.Disk = record.Metadata.Disk
+	metadataPath := filepath.Join(c.config.InstancesDir, name, "metadata.json")
+	return c.saveMetadata(metadata, metadataPath)
+}
+
+// Snapshots returns the snapshots of an instance, oldest first
+func (c *Client) Snapshots(name string) ([]*Snapshot, error) {
+	if _, err := c.loadMetadata(name); err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	return c.loadSnapshots(name)
+}
+
+// DeleteSnapshot removes a snapshot from an instance
+func (c *Client) DeleteSnapshot(name, snapshot string) error {
+	metadata, err := c.getMetadata(name)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	snapshots, err := c.loadSnapshots(name)
+	if err != nil {
+		return err
+	}
+
+	i := findSnapshot(snapshots, snapshot)
+	if i < 0 {
+		return fmt.Errorf("snapshot '%s' not found for '%s'", snapshot, name)
+	}
+
+	switch VMState(metadata.State) {
+	case StateStopped:
+		err = c.runQEMUImg("snapshot", "-d", snapshot, metadata.DiskPath)
+	case StateRunning:
+		err = c.liveSnapshot(name, "snapshot-delete", snapshot)
+	default:
+		return fmt.Errorf("cannot delete snapshots of '%s' while it is %s", name, metadata.State)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+
+	snapshots = append(snapshots[:i], snapshots[i+1:]...)
+	return c.saveSnapshots(name, snapshots)
+}
+
+// liveSnapshot runs one of the snapshot-save, snapshot-load or
+// snapshot-delete jobs against the disk of a running instance
+func (c *Client) liveSnapshot(name, command, tag string) error {
+	monitor, err := c.connectQMP(name)
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+
+	args := map[string]interface{}{
+		"tag":     tag,
+		"devices": []string{diskNodeName},
+	}
+	if command != "snapshot-delete" {
+		args["vmstate"] = diskNodeName
+	}
+
+	if err := runJob(monitor, command, command+"-"+tag, args); err != nil {
+		return err
+	}
+
+	// Make sure the guest runs again after loading a snapshot
+	if command == "snapshot-load" {
+		var status struct {
+			Status string `json:"status"`
+		}
+		if err := monitor.Run("query-status", nil, &status); err == nil && status.Status == "paused" {
+			monitor.Execute("cont", nil)
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) snapshotsPath(name string) string {
+	return filepath.Join(c.config.InstancesDir, name, "snapshots.json")
+}
+
+func (c *Client) loadSnapshots(name string) ([]*Snapshot, error) {
+	data, err := os.ReadFile(c.snapshotsPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*Snapshot
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshots: %w", err)
+	}
+	return snapshots, nil
+}
+
+func (c *Client) saveSnapshots(name string, snapshots []*Snapshot) error {
+	data, err := json.MarshalIndent(snapshots, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.snapshotsPath(name), data, 0644)
+}
+
+func findSnapshot(snapshots []*Snapshot, name string) int {
+	for i, s := range snapshots {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextSnapshotName returns the first unused name of the form snapshotN
+func nextSnapshotName(snapshots []*Snapshot) string {
+	for n := 1; ; n++ {
+		name := fmt.Sprintf("snapshot%d", n)
+		if findSnapshot(snapshots, name) < 0 {
+			return name
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package kvm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// processExitTimeout is how long to wait for QEMU to exit after shutdown
+const processExitTimeout = 10 * time.Second
+
+// stopTimeout is the longest a stop can take, after which a recorded
+// Stopping state no longer means a stop is in progress
+const stopTimeout = shutdownTimeout + processExitTimeout + qmpDialTimeout
+
+// pidFilePath returns the path of the pidfile QEMU writes for an instance
+func (c *Client) pidFilePath(name string) string {
+	return filepath.Join(c.config.InstancesDir, name, "qemu.pid")
+}
+
+// getMetadata loads the metadata of an instance and reconciles the
+// recorded state with the QEMU process and the address with the sources
+// that are cheap to ask, saving any correction
+func (c *Client) getMetadata(name string) (*InstanceMetadata, error) {
+	metadata, err := c.loadMetadata(name)
+	if err != nil {
+		return nil, err
+	}
+
+	state, pid := c.actualState(metadata)
+	ipv4 := c.discoverAddress(metadata, state, false)
+
+	stale := state != StateStopping && metadata.StopSince != nil
+	if string(state) != metadata.State || pid != metadata.PID || ipv4 != metadata.IPv4 || stale {
+		metadata.State = string(state)
+		if state != StateStopping {
+			metadata.StopSince = nil
+		}
+		metadata.PID = pid
+		metadata.IPv4 = ipv4
+		metadataPath := filepath.Join(c.config.InstancesDir, name, "metadata.json")
+		if err := c.saveMetadata(metadata, metadataPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return metadata, nil
+}
+
+// actualState works out the state of an instance from its pidfile, the
+// process table and QMP query-status
+func (c *Client) actualState(metadata *InstanceMetadata) (VMState, int) {
+	pid := c.runningPID(metadata.Name)
+	if pid == 0 {
+		if c.hasSuspendState(metadata.Name) {
+			return StateSuspended, 0
+		}
+		return StateStopped, 0
+	}
+
+	status, err := c.queryStatus(metadata.Name)
+	if err != nil {
+		return StateUnknown, pid
+	}
+
+	switch status {
+	case "running":
+		if metadata.State == string(StateStopping) && stopInProgress(metadata) {
+			// The guest is still working through its shutdown
+			return StateStopping, pid
+		}
+		return StateRunning, pid
+	case "prelaunch", "inmigrate":
+		return StateStarting, pid
+	case "shutdown":
+		return StateStopping, pid
+	default:
+		return StateUnknown, pid
+	}
+}
+
+// stopInProgress reports whether a Stop call may still be waiting for
+// the guest, as opposed to one that was interrupted before it could
+// record the outcome
+func stopInProgress(metadata *InstanceMetadata) bool {
+	return metadata.StopSince != nil && time.Since(*metadata.StopSince) < stopTimeout
+}
+
+// runningPID returns the pid of the QEMU process of an instance, or 0 if
+// it is not running
+func (c *Client) runningPID(name string) int {
+	data, err := os.ReadFile(c.pidFilePath(name))
+	if err != nil {
+		return 0
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+
+	if !c.isInstanceProcess(pid, name) {
+		return 0
+	}
+	return pid
+}
+
+// isInstanceProcess checks /proc/<pid>/cmdline to make sure pid is the
+// QEMU process of this instance and not an unrelated process that reused
+// the pid after a crash or reboot
+func (c *Client) isInstanceProcess(pid int, name string) bool {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+
+	args := bytes.Split(bytes.TrimRight(cmdline, "\x00"), []byte{0})
+	if len(args) == 0 || !strings.Contains(filepath.Base(string(args[0])), "qemu") {
+		return false
+	}
+
+	pidFile := c.pidFilePath(name)
+	for i := 0; i+1 < len(args); i++ {
+		if string(args[i]) == "-pidfile" && string(args[i+1]) == pidFile {
+			return true
+		}
+	}
+	return false
+}
+
+// queryStatus returns the QEMU run state of an instance
+func (c *Client) queryStatus(name string) (string, error) {
+	monitor, err := c.connectQMP(name)
+	if err != nil {
+		return "", err
+	}
+	defer monitor.Close()
+
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := monitor.Run("query-status", nil, &status); err != nil {
+		return "", err
+	}
+	return status.Status, nil
+}
+
+// waitForExit waits until the QEMU process of an instance is gone
+func (c *Client) waitForExit(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for c.runningPID(name) != 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("QEMU process of '%s' did not exit", name)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return nil
+}
+
+// isActive reports whether a state means the QEMU process is alive
+func isActive(state string) bool {
+	switch VMState(state) {
+	case StateRunning, StateStarting, StateStopping, StateUnknown:
+		return true
+	}
+	return false
+}
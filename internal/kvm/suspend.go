@@ -0,0 +1,188 @@
+package kvm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/slackpass/slackpass/internal/qmp"
+)
+
+// resumeTimeout is how long loading the saved state may take on resume
+const resumeTimeout = 5 * time.Minute
+
+// migrationInfo holds the fields of QMP query-migrate we use
+type migrationInfo struct {
+	Status    string `json:"status"`
+	ErrorDesc string `json:"error-desc,omitempty"`
+}
+
+// suspendStatePath returns the path of the file holding the RAM and device
+// state of a suspended instance
+func (c *Client) suspendStatePath(name string) string {
+	return filepath.Join(c.config.InstancesDir, name, "suspend.vmstate")
+}
+
+// hasSuspendState reports whether an instance has saved state to resume
+func (c *Client) hasSuspendState(name string) bool {
+	_, err := os.Stat(c.suspendStatePath(name))
+	return err == nil
+}
+
+// Suspend saves the RAM and device state of a running instance to its
+// instance directory and exits QEMU. The next start resumes from it.
+func (c *Client) Suspend(name string) error {
+	metadata, err := c.getMetadata(name)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	if metadata.State != string(StateRunning) {
+		return fmt.Errorf("cannot suspend '%s' while it is %s", name, metadata.State)
+	}
+	if err := checkMigratable(metadata, "suspend"); err != nil {
+		return err
+	}
+
+	if err := c.saveState(name); err != nil {
+		return err
+	}
+
+	if err := c.quit(name); err != nil {
+		return err
+	}
+	if err := c.waitForExit(name, processExitTimeout); err != nil {
+		return err
+	}
+
+	metadataPath := filepath.Join(c.config.InstancesDir, name, "metadata.json")
+	metadata.State = string(StateSuspended)
+	metadata.PID = 0
+	return c.saveMetadata(metadata, metadataPath)
+}
+
+// Resume starts a suspended instance from its saved state
+func (c *Client) Resume(name string) error {
+	metadata, err := c.getMetadata(name)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	if metadata.State != string(StateSuspended) {
+		return fmt.Errorf("instance '%s' is not suspended", name)
+	}
+
+	return c.Start(name)
+}
+
+// saveState pauses the guest and migrates its state into the suspend
+// state file. The guest is left paused so nothing changes on disk after
+// the state has been written.
+func (c *Client) saveState(name string) error {
+	monitor, err := c.connectQMP(name)
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+
+	if _, err := monitor.Execute("stop", nil); err != nil {
+		return fmt.Errorf("failed to pause guest: %w", err)
+	}
+
+	statePath := c.suspendStatePath(name)
+	partPath := statePath + ".part"
+
+	uri := "exec:cat > " + quoteShellArg(partPath)
+	if _, err := monitor.Execute("migrate", map[string]string{"uri": uri}); err != nil {
+		monitor.Execute("cont", nil)
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+
+	if err := waitForMigration(monitor, jobTimeout); err != nil {
+		monitor.Execute("cont", nil)
+		os.Remove(partPath)
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+
+	if err := os.Rename(partPath, statePath); err != nil {
+		monitor.Execute("cont", nil)
+		return fmt.Errorf("failed to store saved state: %w", err)
+	}
+
+	return nil
+}
+
+// finishResume waits until QEMU has loaded the saved state of an instance
+// started with -incoming, lets the guest continue and removes the state
+// file
+func (c *Client) finishResume(name string) error {
+	monitor, err := c.connectQMP(name)
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+
+	deadline := time.Now().Add(resumeTimeout)
+	for {
+		var status struct {
+			Status string `json:"status"`
+		}
+		if err := monitor.Run("query-status", nil, &status); err != nil {
+			return fmt.Errorf("failed to restore saved state: %w", err)
+		}
+
+		switch status.Status {
+		case "inmigrate":
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out restoring saved state")
+			}
+			time.Sleep(jobPollInterval)
+			continue
+		case "paused":
+			// The guest was paused when its state was saved
+			if _, err := monitor.Execute("cont", nil); err != nil {
+				return fmt.Errorf("failed to continue guest: %w", err)
+			}
+		case "running":
+		default:
+			return fmt.Errorf("failed to restore saved state: guest is %s", status.Status)
+		}
+
+		return os.Remove(c.suspendStatePath(name))
+	}
+}
+
+// waitForMigration polls query-migrate until an outgoing migration has
+// completed or failed
+func waitForMigration(monitor *qmp.Client, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var info migrationInfo
+		if err := monitor.Run("query-migrate", nil, &info); err != nil {
+			return err
+		}
+
+		switch info.Status {
+		case "completed":
+			return nil
+		case "failed", "cancelled":
+			if info.ErrorDesc != "" {
+				return fmt.Errorf("migration %s: %s", info.Status, info.ErrorDesc)
+			}
+			return fmt.Errorf("migration %s", info.Status)
+		}
+
+		if time.Now().After(deadline) {
+			monitor.Execute("migrate_cancel", nil)
+			return fmt.Errorf("timed out waiting for migration")
+		}
+		time.Sleep(jobPollInterval)
+	}
+}
+
+// quoteShellArg quotes s for the shell QEMU runs exec: migration commands in
+func quoteShellArg(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -28,19 +28,44 @@ type Instance struct {
 
 // InstanceMetadata represents the metadata stored for each VM instance
 type InstanceMetadata struct {
-	Name      string    `json:"name"`
-	Image     string    `json:"image"`
-	CPUs      int       `json:"cpus"`
-	Memory    string    `json:"memory"`
-	Disk      string    `json:"disk"`
-	DiskPath  string    `json:"disk_path"`
-	CloudInit string    `json:"cloud_init,omitempty"`
-	State     string    `json:"state"`
-	PID       int       `json:"pid,omitempty"`
-	IPv4      string    `json:"ipv4,omitempty"`
-	MAC       string    `json:"mac,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	Name       string        `json:"name"`
+	Image      string        `json:"image"`
+	BaseImage  string        `json:"base_image,omitempty"`
+	CPUs       int           `json:"cpus"`
+	Memory     string        `json:"memory"`
+	Disk       string        `json:"disk"`
+	DiskPath   string        `json:"disk_path"`
+	User       string        `json:"user,omitempty"`
+	CloudInit  string        `json:"cloud_init,omitempty"`
+	InstanceID string        `json:"instance_id,omitempty"`
+	State      string        `json:"state"`
+	PID        int           `json:"pid,omitempty"`
+	StopSince  *time.Time    `json:"stop_since,omitempty"` // When the running stop began
+	Network    string        `json:"network,omitempty"`    // user or bridge, empty means user
+	Bridge     string        `json:"bridge,omitempty"`
+	SSHPort    int           `json:"ssh_port,omitempty"`
+	IPv4       string        `json:"ipv4,omitempty"`
+	MAC        string        `json:"mac,omitempty"`
+	Forwards   []PortForward `json:"forwards,omitempty"`
+	Mounts     []Mount       `json:"mounts,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+}
+
+// PortForward represents a host port forwarded to a port of the guest
+type PortForward struct {
+	Protocol  string `json:"protocol"` // tcp or udp
+	Address   string `json:"address"`  // Host address the port is bound on
+	HostPort  int    `json:"host_port"`
+	GuestPort int    `json:"guest_port"`
+}
+
+// Mount represents a host directory shared with the guest
+type Mount struct {
+	Source string `json:"source"` // Host directory
+	Target string `json:"target"` // Mount point in the guest
+	Tag    string `json:"tag"`    // Tag the guest mounts the share by
+	Type   string `json:"type"`   // virtiofs or 9p
 }
 
 // QEMUProcess represents a running QEMU process
@@ -70,14 +95,14 @@ type DiskConfig struct {
 
 // CloudInitConfig represents cloud-init configuration
 type CloudInitConfig struct {
-	UserData     string            `json:"user_data,omitempty"`
-	MetaData     string            `json:"meta_data,omitempty"`
-	NetworkData  string            `json:"network_data,omitempty"`
-	SSHKeys      []string          `json:"ssh_keys,omitempty"`
-	Packages     []string          `json:"packages,omitempty"`
-	RunCommands  []string          `json:"run_commands,omitempty"`
-	WriteFiles   []CloudInitFile   `json:"write_files,omitempty"`
-	Users        []CloudInitUser   `json:"users,omitempty"`
+	UserData    string          `json:"user_data,omitempty"`
+	MetaData    string          `json:"meta_data,omitempty"`
+	NetworkData string          `json:"network_data,omitempty"`
+	SSHKeys     []string        `json:"ssh_keys,omitempty"`
+	Packages    []string        `json:"packages,omitempty"`
+	RunCommands []string        `json:"run_commands,omitempty"`
+	WriteFiles  []CloudInitFile `json:"write_files,omitempty"`
+	Users       []CloudInitUser `json:"users,omitempty"`
 }
 
 // CloudInitFile represents a file to be written by cloud-init
@@ -95,4 +120,13 @@ type CloudInitUser struct {
 	Sudo              string   `json:"sudo,omitempty"`
 	Shell             string   `json:"shell,omitempty"`
 	Groups            []string `json:"groups,omitempty"`
-}
\ No newline at end of file
+}
+
+// Snapshot represents a named snapshot of an instance
+type Snapshot struct {
+	Name      string           `json:"name"`
+	Comment   string           `json:"comment,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+	Live      bool             `json:"live"`     // Taken while running, includes RAM state
+	Metadata  InstanceMetadata `json:"metadata"` // Instance configuration at snapshot time
+}
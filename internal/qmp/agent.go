@@ -0,0 +1,93 @@
+package qmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Agent is a connection to a QEMU guest agent socket. Unlike QMP the
+// guest agent sends no greeting and answers one command at a time.
+type Agent struct {
+	conn    net.Conn
+	encoder *json.Encoder
+	decoder *json.Decoder
+	timeout time.Duration
+}
+
+// DialAgent connects to the guest agent socket at path and synchronizes
+// with the agent, discarding any stale responses. Every command must be
+// answered within timeout.
+func DialAgent(path string, timeout time.Duration) (*Agent, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Agent{
+		conn:    conn,
+		encoder: json.NewEncoder(conn),
+		decoder: json.NewDecoder(conn),
+		timeout: timeout,
+	}
+
+	if err := a.sync(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("guest agent is not responding: %w", err)
+	}
+
+	return a, nil
+}
+
+// Run runs a guest agent command and decodes its result into result,
+// which may be nil
+func (a *Agent) Run(name string, args, result interface{}) error {
+	a.conn.SetDeadline(time.Now().Add(a.timeout))
+
+	if err := a.encoder.Encode(&command{Execute: name, Arguments: args}); err != nil {
+		return err
+	}
+
+	var msg message
+	if err := a.decoder.Decode(&msg); err != nil {
+		return err
+	}
+	if msg.Error != nil {
+		return msg.Error
+	}
+	if result == nil || msg.Return == nil {
+		return nil
+	}
+	return json.Unmarshal(msg.Return, result)
+}
+
+// Close closes the connection
+func (a *Agent) Close() error {
+	return a.conn.Close()
+}
+
+// sync sends guest-sync with a random id and reads until the matching
+// response arrives, so responses to commands of an earlier, abandoned
+// connection are not mistaken for ours
+func (a *Agent) sync() error {
+	a.conn.SetDeadline(time.Now().Add(a.timeout))
+
+	id := rand.Int63()
+	if err := a.encoder.Encode(&command{Execute: "guest-sync", Arguments: map[string]int64{"id": id}}); err != nil {
+		return err
+	}
+
+	for {
+		var msg message
+		if err := a.decoder.Decode(&msg); err != nil {
+			return err
+		}
+
+		var got int64
+		if json.Unmarshal(msg.Return, &got) == nil && got == id {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package qmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestDialAgentSkipsStaleResponses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qga.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("accept failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		f := &fakeQEMU{t: t, conn: conn, encoder: json.NewEncoder(conn), decoder: json.NewDecoder(conn)}
+
+		var sync struct {
+			Execute   string `json:"execute"`
+			Arguments struct {
+				ID int64 `json:"id"`
+			} `json:"arguments"`
+		}
+		if err := f.decoder.Decode(&sync); err != nil || sync.Execute != "guest-sync" {
+			t.Errorf("got %+v, %v, want guest-sync", sync, err)
+			return
+		}
+		// Answers to commands of an earlier connection come first
+		f.send(`{"return": {"pid": 1}}`)
+		f.send(`{"return": 12345}`)
+		f.send(fmt.Sprintf(`{"return": %d}`, sync.Arguments.ID))
+
+		f.expect("guest-exec-status")
+		f.send(`{"error": {"class": "GenericError", "desc": "Invalid parameter 'pid'"}}`)
+		f.expect("guest-ping")
+		f.send(`{"return": {}}`)
+	}()
+
+	a, err := DialAgent(path, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	err = a.Run("guest-exec-status", map[string]int{"pid": 1}, nil)
+	if qmpErr, ok := err.(*Error); !ok || qmpErr.Class != "GenericError" {
+		t.Errorf("got error %v, want GenericError", err)
+	}
+	if err := a.Run("guest-ping", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
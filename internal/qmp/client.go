@@ -0,0 +1,242 @@
+// Package qmp implements a client for the QEMU Machine Protocol.
+package qmp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// eventBuffer is how many unread events are kept before new ones are dropped
+const eventBuffer = 64
+
+// Client is a connection to a QMP socket
+type Client struct {
+	conn    net.Conn
+	encoder *json.Encoder
+	timeout time.Duration
+
+	// mu serializes commands, one command waits for a response at a time
+	mu     sync.Mutex
+	nextID uint64
+
+	// waitMu guards waiting, the id of the command a response is expected
+	// for. Responses with another id came too late and are dropped.
+	waitMu    sync.Mutex
+	waiting   uint64
+	responses chan *message
+	events    chan Event
+
+	done chan struct{}
+	err  error
+}
+
+// Event is an asynchronous event sent by QEMU
+type Event struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+}
+
+// Error is an error returned by QEMU for a command
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Desc)
+}
+
+// message is any message QEMU may send
+type message struct {
+	ID       uint64          `json:"id,omitempty"`
+	Greeting json.RawMessage `json:"QMP,omitempty"`
+	Return   json.RawMessage `json:"return,omitempty"`
+	Error    *Error          `json:"error,omitempty"`
+	Event
+}
+
+type command struct {
+	ID        uint64      `json:"id,omitempty"`
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// Dial connects to the QMP socket at path and negotiates capabilities.
+// Every command must be answered within timeout.
+func Dial(path string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:      conn,
+		encoder:   json.NewEncoder(conn),
+		timeout:   timeout,
+		responses: make(chan *message, 1),
+		events:    make(chan Event, eventBuffer),
+		done:      make(chan struct{}),
+	}
+
+	decoder := json.NewDecoder(conn)
+
+	// QEMU greets first, then waits for qmp_capabilities
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	var greeting message
+	if err := decoder.Decode(&greeting); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read QMP greeting: %w", err)
+	}
+	if greeting.Greeting == nil {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected QMP greeting")
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	go c.readLoop(decoder)
+
+	if _, err := c.Execute("qmp_capabilities", nil); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("QMP capabilities negotiation failed: %w", err)
+	}
+
+	return c, nil
+}
+
+// Execute runs a command and returns its raw result. It gives up when
+// QEMU does not answer in time, e.g. because it is wedged.
+func (c *Client) Execute(name string, args interface{}) (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nextID++
+	id := c.nextID
+	c.setWaiting(id)
+	defer c.setWaiting(0)
+
+	if err := c.encoder.Encode(&command{ID: id, Execute: name, Arguments: args}); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	var msg *message
+	select {
+	case msg = <-c.responses:
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out waiting for QEMU to answer %s", name)
+	case <-c.done:
+		// The reply may have arrived just before the connection closed
+		select {
+		case msg = <-c.responses:
+		default:
+			return nil, c.err
+		}
+	}
+
+	if msg.Error != nil {
+		return nil, msg.Error
+	}
+	return msg.Return, nil
+}
+
+// Run runs a command and decodes its result into result, which may be nil
+func (c *Client) Run(name string, args, result interface{}) error {
+	raw, err := c.Execute(name, args)
+	if err != nil {
+		return err
+	}
+	if result == nil || raw == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, result)
+}
+
+// Events returns the channel asynchronous events are delivered on
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// WaitForEvent waits until an event with the given name arrives, skipping
+// any other events
+func (c *Client) WaitForEvent(name string, timeout time.Duration) (*Event, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case event := <-c.events:
+			if event.Event == name {
+				return &event, nil
+			}
+		case <-c.done:
+			// QEMU often sends the event right before it exits
+			for {
+				select {
+				case event := <-c.events:
+					if event.Event == name {
+						return &event, nil
+					}
+				default:
+					return nil, c.err
+				}
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("timed out waiting for %s event", name)
+		}
+	}
+}
+
+// setWaiting sets the id of the command that expects a response, 0 for
+// none. A response that was delivered but not picked up is discarded.
+func (c *Client) setWaiting(id uint64) {
+	c.waitMu.Lock()
+	defer c.waitMu.Unlock()
+
+	c.waiting = id
+	select {
+	case <-c.responses:
+	default:
+	}
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) readLoop(decoder *json.Decoder) {
+	for {
+		var msg message
+		if err := decoder.Decode(&msg); err != nil {
+			c.err = fmt.Errorf("QMP connection closed: %w", err)
+			close(c.done)
+			return
+		}
+
+		if msg.Event.Event != "" {
+			select {
+			case c.events <- msg.Event:
+			default:
+				// Nobody is listening, drop the event
+			}
+			continue
+		}
+
+		// Nobody waits for a response to a command that timed out
+		c.waitMu.Lock()
+		if msg.ID != 0 && msg.ID == c.waiting {
+			c.responses <- &msg
+			c.waiting = 0
+		}
+		c.waitMu.Unlock()
+	}
+}
@@ -0,0 +1,298 @@
+package qmp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+// fakeQEMU is the QEMU side of a QMP connection
+type fakeQEMU struct {
+	t       *testing.T
+	conn    net.Conn
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+// expect reads the next command and fails the test unless it is name.
+// It returns the id of the command.
+func (f *fakeQEMU) expect(name string) uint64 {
+	var cmd command
+	if err := f.decoder.Decode(&cmd); err != nil {
+		f.t.Errorf("failed to read command %s: %v", name, err)
+		return 0
+	}
+	if cmd.Execute != name {
+		f.t.Errorf("got command %q, want %q", cmd.Execute, name)
+	}
+	return cmd.ID
+}
+
+// reply answers the command with the given id, body being the members
+// of the response besides the id
+func (f *fakeQEMU) reply(id uint64, body string) {
+	f.send(fmt.Sprintf(`{"id": %d, %s}`, id, body))
+}
+
+// send writes a raw JSON message
+func (f *fakeQEMU) send(msg string) {
+	if _, err := f.conn.Write([]byte(msg + "\r\n")); err != nil {
+		f.t.Errorf("failed to send %s: %v", msg, err)
+	}
+}
+
+// serveQMP listens on a socket and runs script for the first connection
+// after the greeting and capabilities negotiation, then closes it. It
+// returns the socket path and a channel that is closed once script is
+// done.
+func serveQMP(t *testing.T, script func(f *fakeQEMU)) (string, <-chan struct{}) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "qmp.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("accept failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		f := &fakeQEMU{t: t, conn: conn, encoder: json.NewEncoder(conn), decoder: json.NewDecoder(conn)}
+		f.send(`{"QMP": {"version": {"qemu": {"micro": 0, "minor": 2, "major": 8}}, "capabilities": ["oob"]}}`)
+		f.reply(f.expect("qmp_capabilities"), `"return": {}`)
+		script(f)
+	}()
+	return path, done
+}
+
+func TestDialNegotiatesCapabilities(t *testing.T) {
+	path, done := serveQMP(t, func(f *fakeQEMU) {
+		f.reply(f.expect("query-status"), `"return": {"status": "running", "running": true}`)
+	})
+
+	c, err := Dial(path, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var status struct {
+		Status  string `json:"status"`
+		Running bool   `json:"running"`
+	}
+	if err := c.Run("query-status", nil, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != "running" || !status.Running {
+		t.Errorf("got status %+v", status)
+	}
+	<-done
+}
+
+func TestDialRejectsMissingGreeting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qmp.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(`{"return": {}}` + "\r\n"))
+	}()
+
+	if _, err := Dial(path, testTimeout); err == nil || !strings.Contains(err.Error(), "greeting") {
+		t.Fatalf("got error %v, want a greeting error", err)
+	}
+}
+
+func TestExecuteReturnsError(t *testing.T) {
+	path, done := serveQMP(t, func(f *fakeQEMU) {
+		f.reply(f.expect("device_del"), `"error": {"class": "DeviceNotFound", "desc": "Device 'net9' not found"}`)
+		f.reply(f.expect("query-status"), `"return": {"status": "running"}`)
+	})
+
+	c, err := Dial(path, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Execute("device_del", map[string]string{"id": "net9"})
+	var qmpErr *Error
+	if !errors.As(err, &qmpErr) {
+		t.Fatalf("got error %v, want a QMP error", err)
+	}
+	if qmpErr.Class != "DeviceNotFound" || qmpErr.Desc != "Device 'net9' not found" {
+		t.Errorf("got error %+v", qmpErr)
+	}
+
+	// The connection stays usable after an error reply
+	if _, err := c.Execute("query-status", nil); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func TestEventsInterleavedWithReply(t *testing.T) {
+	path, done := serveQMP(t, func(f *fakeQEMU) {
+		id := f.expect("system_powerdown")
+		f.send(`{"event": "POWERDOWN", "timestamp": {"seconds": 1, "microseconds": 2}}`)
+		f.send(`{"event": "RESUME", "timestamp": {"seconds": 1, "microseconds": 3}}`)
+		f.reply(id, `"return": {}`)
+		f.send(`{"event": "SHUTDOWN", "data": {"guest": true, "reason": "guest-shutdown"}, "timestamp": {"seconds": 2, "microseconds": 0}}`)
+	})
+
+	c, err := Dial(path, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	raw, err := c.Execute("system_powerdown", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "{}" {
+		t.Errorf("got result %s, want {}", raw)
+	}
+
+	select {
+	case event := <-c.Events():
+		if event.Event != "POWERDOWN" || event.Timestamp.Seconds != 1 || event.Timestamp.Microseconds != 2 {
+			t.Errorf("got event %+v, want POWERDOWN", event)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("POWERDOWN event was not delivered")
+	}
+
+	// RESUME is skipped while waiting for SHUTDOWN
+	event, err := c.WaitForEvent("SHUTDOWN", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data struct {
+		Guest  bool   `json:"guest"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if !data.Guest || data.Reason != "guest-shutdown" {
+		t.Errorf("got event data %+v", data)
+	}
+	<-done
+}
+
+func TestExecuteFailsWhenPeerCloses(t *testing.T) {
+	path, done := serveQMP(t, func(f *fakeQEMU) {
+		// QEMU exits while the command is running
+		f.expect("quit")
+	})
+
+	c, err := Dial(path, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := c.Execute("quit", nil)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err == nil || !strings.Contains(err.Error(), "QMP connection closed") {
+			t.Errorf("got error %v, want the connection to be closed", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Execute did not return after the connection was closed")
+	}
+	<-done
+
+	// Later calls fail instead of blocking
+	if _, err := c.Execute("query-status", nil); err == nil {
+		t.Error("expected an error on a closed connection")
+	}
+	if _, err := c.WaitForEvent("SHUTDOWN", testTimeout); err == nil {
+		t.Error("expected an error waiting for an event on a closed connection")
+	}
+}
+
+func TestExecuteTimesOut(t *testing.T) {
+	late := make(chan struct{})
+	path, done := serveQMP(t, func(f *fakeQEMU) {
+		// QEMU is wedged and answers only after the client gave up
+		id := f.expect("query-status")
+		<-late
+		f.reply(id, `"return": {"status": "paused"}`)
+
+		f.reply(f.expect("query-name"), `"return": {"name": "test"}`)
+	})
+
+	c, err := Dial(path, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Execute("query-status", nil); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("got error %v, want a timeout", err)
+	}
+	close(late)
+
+	// The late reply is dropped rather than taken for the next one
+	var name struct {
+		Name string `json:"name"`
+	}
+	if err := c.Run("query-name", nil, &name); err != nil {
+		t.Fatal(err)
+	}
+	if name.Name != "test" {
+		t.Errorf("got %+v, want the reply to query-name", name)
+	}
+	<-done
+}
+
+func TestUnsolicitedRepliesDoNotBlockEvents(t *testing.T) {
+	path, done := serveQMP(t, func(f *fakeQEMU) {
+		// Replies nobody waits for, followed by an event
+		for i := 0; i < 3; i++ {
+			f.send(fmt.Sprintf(`{"id": %d, "return": {}}`, 100+i))
+		}
+		f.send(`{"return": {}}`)
+		f.send(`{"event": "STOP", "timestamp": {"seconds": 1, "microseconds": 0}}`)
+	})
+
+	c, err := Dial(path, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.WaitForEvent("STOP", testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
@@ -1,91 +1,191 @@
 package ssh
 
 import (
+	"errors"
 	"fmt"
-	"net"
 	"os"
-	"os/exec"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/ssh"
 	"github.com/slackpass/slackpass/internal/config"
+	"github.com/slackpass/slackpass/internal/kvm"
+	"golang.org/x/crypto/ssh"
 )
 
 // Client handles SSH operations
 type Client struct {
-	config *config.Config
+	config    *config.Config
+	kvmClient *kvm.Client
 }
 
 // NewClient creates a new SSH client
 func NewClient(cfg *config.Config) *Client {
 	return &Client{
-		config: cfg,
+		config:    cfg,
+		kvmClient: kvm.NewClient(cfg),
+	}
+}
+
+// ErrNotReady is returned when an instance did not become ready in time
+var ErrNotReady = errors.New("instance did not become ready in time")
+
+// readyScript waits for cloud-init to finish its work in the guest. Where
+// the cloud-init command is missing, the file cloud-init writes when it is
+// done is waited for instead.
+const readyScript = `if command -v cloud-init >/dev/null 2>&1; then
+  exec cloud-init status --wait --long
+fi
+[ -d /var/lib/cloud ] || exit 0
+while [ ! -e /var/lib/cloud/instance/boot-finished ]; do sleep 1; done`
+
+// cloudInitDegraded is the exit status of `cloud-init status` when it
+// finished with recoverable errors
+const cloudInitDegraded = 2
+
+// WaitForConnection waits until the instance accepts an SSH login with
+// its key and cloud-init has finished, or the timeout passes
+func (c *Client) WaitForConnection(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	var client *ssh.Client
+	for client == nil {
+		// A bridged instance's address is only known once it is up
+		metadata, err := c.runningInstance(name)
+		if err != nil {
+			if err := c.checkBooting(name); err != nil {
+				return err
+			}
+		} else if _, _, err := c.instanceAddress(metadata); err == nil {
+			client, err = c.connect(name)
+			if errors.Is(err, errHostKeyChanged) {
+				return err
+			}
+		}
+
+		if client == nil {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%w: no SSH login to %s", ErrNotReady, name)
+			}
+			time.Sleep(1 * time.Second)
+		}
+	}
+	defer client.Close()
+
+	return waitForCloudInit(client, name, time.Until(deadline))
+}
+
+// checkBooting returns an error when an instance that is not running yet
+// will not come up by itself, e.g. because it was stopped or deleted.
+// Instances that are still starting, or whose state is not known for the
+// moment, are worth waiting for.
+func (c *Client) checkBooting(name string) error {
+	metadata, err := c.kvmClient.Metadata(name)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	switch kvm.VMState(metadata.State) {
+	case kvm.StateStopped, kvm.StateSuspended, kvm.StateDeleted:
+		return fmt.Errorf("instance '%s' is %s", name, strings.ToLower(metadata.State))
+	case kvm.StateRunning:
+		if metadata.Network != kvm.NetworkBridge && metadata.SSHPort == 0 {
+			return fmt.Errorf("instance '%s' has no SSH port", name)
+		}
 	}
+	return nil
 }
 
-// WaitForConnection waits for SSH to become available on the instance
-func (c *Client) WaitForConnection(name string) error {
-	// Get instance IP address
-	ip, port, err := c.getInstanceAddress(name)
+// waitForCloudInit runs readyScript on an open connection, giving up when
+// the timeout passes
+func waitForCloudInit(client *ssh.Client, name string, timeout time.Duration) error {
+	session, err := client.NewSession()
 	if err != nil {
-		return fmt.Errorf("failed to get instance address: %w", err)
+		return fmt.Errorf("failed to create SSH session: %w", err)
+	}
+	defer session.Close()
+
+	type result struct {
+		output []byte
+		err    error
 	}
+	done := make(chan result, 1)
+	go func() {
+		command := buildCommand([]string{"sh", "-c", readyScript}, &ExecOptions{})
+		output, err := session.CombinedOutput(command)
+		done <- result{output, err}
+	}()
 
-	// Wait for SSH port to be open
-	timeout := time.Duration(c.config.SSHTimeout) * time.Second
-	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-	for time.Since(start) < timeout {
-		conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", ip, port), 5*time.Second)
-		if err == nil {
-			conn.Close()
-			// Wait a bit more for SSH service to be fully ready
-			time.Sleep(2 * time.Second)
+	select {
+	case r := <-done:
+		var exitErr *ssh.ExitError
+		if r.err == nil || (errors.As(r.err, &exitErr) && exitErr.ExitStatus() == cloudInitDegraded) {
 			return nil
 		}
-		time.Sleep(1 * time.Second)
+		// `cloud-init status --wait` prints a dot while it waits
+		output := strings.TrimSpace(strings.TrimLeft(string(r.output), ".\n"))
+		return fmt.Errorf("cloud-init failed on %s: %w: %s", name, r.err, output)
+	case <-timer.C:
+		return fmt.Errorf("%w: cloud-init has not finished on %s", ErrNotReady, name)
 	}
-
-	return fmt.Errorf("timeout waiting for SSH connection to %s", name)
 }
 
-// Shell opens an interactive shell session to the instance
+// Shell opens an interactive shell session to the instance. If the
+// remote shell exits with a non-zero status, an *ssh.ExitError is returned.
 func (c *Client) Shell(name string) error {
-	ip, port, err := c.getInstanceAddress(name)
+	client, err := c.connect(name)
 	if err != nil {
-		return fmt.Errorf("failed to get instance address: %w", err)
+		return err
 	}
+	defer client.Close()
 
-	// Use external SSH client for interactive session
-	cmd := exec.Command("ssh",
-		"-i", c.config.SSHKeyPath,
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
-		"-p", fmt.Sprintf("%d", port),
-		fmt.Sprintf("%s@%s", c.config.SSHUser, ip),
-	)
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create SSH session: %w", err)
+	}
+	defer session.Close()
+
+	terminal, err := requestPTY(session)
+	if err != nil {
+		return fmt.Errorf("failed to set up terminal: %w", err)
+	}
+	defer terminal.restore()
+
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+	if err := attachStdin(session); err != nil {
+		return err
+	}
 
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if err := session.Shell(); err != nil {
+		return fmt.Errorf("failed to start shell: %w", err)
+	}
 
-	return cmd.Run()
+	return session.Wait()
 }
 
-// Exec executes a command on the instance
-func (c *Client) Exec(name, command string) error {
-	ip, port, err := c.getInstanceAddress(name)
-	if err != nil {
-		return fmt.Errorf("failed to get instance address: %w", err)
+// Exec runs a command on the instance with stdin, stdout and stderr
+// connected to the local ones. The arguments are quoted for the remote
+// shell. If the command exits with a non-zero status, an *ssh.ExitError
+// is returned.
+func (c *Client) Exec(name string, args []string, opts *ExecOptions) error {
+	if opts == nil {
+		opts = &ExecOptions{}
 	}
 
-	// Create SSH client connection
-	client, err := c.createSSHClient(ip, port)
+	client, err := c.connect(name)
 	if err != nil {
-		return fmt.Errorf("failed to create SSH client: %w", err)
+		return err
 	}
 	defer client.Close()
 
+	return execSession(client, args, opts)
+}
+
+// execSession runs a command for Exec on an open connection
+func execSession(client *ssh.Client, args []string, opts *ExecOptions) error {
 	// Create session
 	session, err := client.NewSession()
 	if err != nil {
@@ -93,104 +193,137 @@ func (c *Client) Exec(name, command string) error {
 	}
 	defer session.Close()
 
+	if opts.TTY {
+		terminal, err := requestPTY(session)
+		if err != nil {
+			return fmt.Errorf("failed to set up terminal: %w", err)
+		}
+		if terminal == nil {
+			// Not attached to a terminal, but a PTY was asked for anyway
+			if err := session.RequestPty(defaultTerm, 24, 80, ssh.TerminalModes{}); err != nil {
+				return fmt.Errorf("failed to request PTY: %w", err)
+			}
+		}
+		defer terminal.restore()
+	}
+
 	// Set up I/O
 	session.Stdout = os.Stdout
 	session.Stderr = os.Stderr
+	if err := attachStdin(session); err != nil {
+		return err
+	}
 
 	// Run command
-	return session.Run(command)
+	if err := session.Start(buildCommand(args, opts)); err != nil {
+		return fmt.Errorf("failed to start command: %w", err)
+	}
+	return session.Wait()
 }
 
-// CopyFile copies a file to the instance
-func (c *Client) CopyFile(name, localPath, remotePath string) error {
-	ip, port, err := c.getInstanceAddress(name)
+// Run runs a command on the instance without any input and returns its
+// combined output. A failure includes the output in the error.
+func (c *Client) Run(name string, args []string) ([]byte, error) {
+	client, err := c.connect(name)
 	if err != nil {
-		return fmt.Errorf("failed to get instance address: %w", err)
+		return nil, err
 	}
+	defer client.Close()
 
-	// Use SCP for file transfer
-	cmd := exec.Command("scp",
-		"-i", c.config.SSHKeyPath,
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
-		"-P", fmt.Sprintf("%d", port),
-		localPath,
-		fmt.Sprintf("%s@%s:%s", c.config.SSHUser, ip, remotePath),
-	)
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSH session: %w", err)
+	}
+	defer session.Close()
 
-	return cmd.Run()
+	output, err := session.CombinedOutput(buildCommand(args, &ExecOptions{}))
+	if err != nil {
+		if trimmed := strings.TrimSpace(string(output)); trimmed != "" {
+			return output, fmt.Errorf("%s: %w: %s", args[0], err, trimmed)
+		}
+		return output, fmt.Errorf("%s: %w", args[0], err)
+	}
+	return output, nil
 }
 
 // Helper methods
 
-func (c *Client) getInstanceAddress(name string) (string, int, error) {
-	// For now, return localhost with a calculated port
-	// TODO: Implement proper IP discovery from QEMU/libvirt
-	// This is a simplified implementation that assumes port forwarding
-	
-	// Calculate port based on instance name hash
-	port := 2222 // Base port
-	for _, char := range name {
-		port += int(char)
+// runningInstance returns the metadata of an instance that must be running
+func (c *Client) runningInstance(name string) (*kvm.InstanceMetadata, error) {
+	metadata, err := c.kvmClient.Metadata(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	if metadata.State != string(kvm.StateRunning) {
+		return nil, fmt.Errorf("instance '%s' is not running", name)
+	}
+	if metadata.Network != kvm.NetworkBridge && metadata.SSHPort == 0 {
+		return nil, fmt.Errorf("instance '%s' has no SSH port", name)
+	}
+
+	return metadata, nil
+}
+
+// instanceAddress returns the host and port SSH is reachable on
+func (c *Client) instanceAddress(metadata *kvm.InstanceMetadata) (string, int, error) {
+	// A bridged guest is reached directly on its own address
+	if metadata.Network == kvm.NetworkBridge {
+		if metadata.IPv4 == "" {
+			return "", 0, fmt.Errorf("address of '%s' is not known yet", metadata.Name)
+		}
+		return metadata.IPv4, c.config.SSHPort, nil
 	}
-	port = 2222 + (port % 1000) // Keep in reasonable range
 
-	return "127.0.0.1", port, nil
+	// SSH is forwarded from the host's loopback address
+	return "127.0.0.1", metadata.SSHPort, nil
 }
 
-func (c *Client) createSSHClient(host string, port int) (*ssh.Client, error) {
-	// Read private key
-	key, err := os.ReadFile(c.config.SSHKeyPath)
+// loginUser returns the user to log in to an instance as: the one chosen
+// at launch, falling back to the configured ssh_user
+func (c *Client) loginUser(metadata *kvm.InstanceMetadata) string {
+	if metadata.User != "" {
+		return metadata.User
+	}
+	return c.config.SSHUser
+}
+
+// connect opens an SSH connection to the instance
+func (c *Client) connect(name string) (*ssh.Client, error) {
+	metadata, err := c.runningInstance(name)
+	if err != nil {
+		return nil, err
+	}
+	ip, port, err := c.instanceAddress(metadata)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read SSH key: %w", err)
+		return nil, err
 	}
 
-	// Parse private key
-	signer, err := ssh.ParsePrivateKey(key)
+	signer, err := c.signer(name)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse SSH key: %w", err)
+		return nil, err
 	}
 
+	client, err := c.createSSHClient(name, ip, port, c.loginUser(metadata), signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SSH client: %w", err)
+	}
+	return client, nil
+}
+
+func (c *Client) createSSHClient(name, host string, port int, user string, signer ssh.Signer) (*ssh.Client, error) {
 	// SSH client configuration
 	config := &ssh.ClientConfig{
-		User: c.config.SSHUser,
+		User: user,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         10 * time.Second,
+		HostKeyCallback:   c.hostKeyCallback(name),
+		HostKeyAlgorithms: c.hostKeyAlgorithms(name),
+		Timeout:           10 * time.Second,
 	}
 
 	// Connect to SSH server
 	address := fmt.Sprintf("%s:%d", host, port)
 	return ssh.Dial("tcp", address, config)
 }
-
-// GenerateSSHKey generates an SSH key pair for slackpass
-func (c *Client) GenerateSSHKey() error {
-	// Check if key already exists
-	if _, err := os.Stat(c.config.SSHKeyPath); err == nil {
-		return nil // Key already exists
-	}
-
-	// Generate SSH key pair using ssh-keygen
-	cmd := exec.Command("ssh-keygen",
-		"-t", "rsa",
-		"-b", "2048",
-		"-f", c.config.SSHKeyPath,
-		"-N", "", // No passphrase
-		"-C", "slackpass@localhost",
-	)
-
-	return cmd.Run()
-}
-
-// GetPublicKey returns the public key content
-func (c *Client) GetPublicKey() (string, error) {
-	pubKeyPath := c.config.SSHKeyPath + ".pub"
-	data, err := os.ReadFile(pubKeyPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read public key: %w", err)
-	}
-	return string(data), nil
-}
\ No newline at end of file
@@ -0,0 +1,195 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/slackpass/slackpass/internal/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeServer is an in-process SSH server that accepts one user key and
+// ends every command with a fixed exit status
+type fakeServer struct {
+	addr     *net.TCPAddr
+	status   uint32
+	commands chan string
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func startServer(t *testing.T, hostKey ssh.Signer, userKey ssh.PublicKey, status uint32) *fakeServer {
+	t.Helper()
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(userKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &fakeServer{addr: l.Addr().(*net.TCPAddr), status: status, commands: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, cfg)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	defer conn.Close()
+	_, channels, requests, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer channel.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var exec struct{ Command string }
+				ssh.Unmarshal(req.Payload, &exec)
+				req.Reply(true, nil)
+				s.commands <- exec.Command
+
+				channel.Write([]byte("ran " + exec.Command + "\n"))
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{s.status}))
+				return
+			}
+		}()
+	}
+}
+
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	return &Client{config: &config.Config{DataDir: t.TempDir()}}
+}
+
+func TestExecPassesExitStatus(t *testing.T) {
+	userKey := newSigner(t)
+	server := startServer(t, newSigner(t), userKey.PublicKey(), 3)
+	c := newTestClient(t)
+
+	client, err := c.createSSHClient("test", "127.0.0.1", server.addr.Port, "user", userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = execSession(client, []string{"sh", "-c", "exit 3"}, &ExecOptions{WorkDir: "/tmp"})
+
+	// main exits with the status of the remote command
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("got error %v, want an *ssh.ExitError", err)
+	}
+	if exitErr.ExitStatus() != 3 {
+		t.Errorf("got exit status %d, want 3", exitErr.ExitStatus())
+	}
+	if got, want := <-server.commands, "cd /tmp && sh -c 'exit 3'"; got != want {
+		t.Errorf("got command %q, want %q", got, want)
+	}
+}
+
+func TestExecSucceeds(t *testing.T) {
+	userKey := newSigner(t)
+	server := startServer(t, newSigner(t), userKey.PublicKey(), 0)
+	c := newTestClient(t)
+
+	client, err := c.createSSHClient("test", "127.0.0.1", server.addr.Port, "user", userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := execSession(client, []string{"true"}, &ExecOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostKeyIsPinned(t *testing.T) {
+	userKey := newSigner(t)
+	hostKey := newSigner(t)
+	server := startServer(t, hostKey, userKey.PublicKey(), 0)
+	c := newTestClient(t)
+
+	// The first connection trusts and records the host key
+	client, err := c.createSSHClient("test", "127.0.0.1", server.addr.Port, "user", userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	data, err := os.ReadFile(filepath.Join(c.config.DataDir, "known_hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), HostAlias("test")+" ") {
+		t.Errorf("host key was not pinned under the alias: %q", data)
+	}
+
+	// It is still accepted later, on another port
+	other := startServer(t, hostKey, userKey.PublicKey(), 0)
+	client, err = c.createSSHClient("test", "127.0.0.1", other.addr.Port, "user", userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	// A server with another key is refused
+	impostor := startServer(t, newSigner(t), userKey.PublicKey(), 0)
+	_, err = c.createSSHClient("test", "127.0.0.1", impostor.addr.Port, "user", userKey)
+	if !errors.Is(err, errHostKeyChanged) {
+		t.Fatalf("got error %v, want the host key to be rejected", err)
+	}
+
+	// Other instances are not affected by the pinned key
+	client, err = c.createSSHClient("other", "127.0.0.1", impostor.addr.Port, "user", userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
@@ -0,0 +1,61 @@
+package ssh
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ExecOptions controls how a command is run by Exec
+type ExecOptions struct {
+	TTY     bool     // Allocate a PTY for the command
+	Env     []string // Extra environment variables as KEY=VALUE
+	WorkDir string   // Directory to run the command in
+}
+
+// buildCommand turns an argument list into a command line for the remote
+// shell, applying the working directory and environment of opts
+func buildCommand(args []string, opts *ExecOptions) string {
+	var b strings.Builder
+
+	if opts.WorkDir != "" {
+		fmt.Fprintf(&b, "cd %s && ", shellQuote(opts.WorkDir))
+	}
+
+	if len(opts.Env) > 0 {
+		b.WriteString("env")
+		for _, env := range opts.Env {
+			b.WriteString(" " + shellQuote(env))
+		}
+		b.WriteString(" ")
+	}
+
+	for i, arg := range args {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString(shellQuote(arg))
+	}
+
+	return b.String()
+}
+
+// shellQuote quotes s for a POSIX shell. Words made only of safe
+// characters are left alone to keep commands readable.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+
+	safe := true
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
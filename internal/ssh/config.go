@@ -0,0 +1,81 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/slackpass/slackpass/internal/kvm"
+)
+
+// configHeader starts the generated OpenSSH config file
+const configHeader = `# Generated by slackpass, changes are overwritten.
+# Use it from ~/.ssh/config with: Include %s
+
+`
+
+// ConfigPath returns the OpenSSH config file slackpass keeps up to date
+// with its instances
+func (c *Client) ConfigPath() string {
+	return filepath.Join(c.config.DataDir, "ssh_config")
+}
+
+// WriteConfig writes a Host block named after HostAlias for every
+// instance, so plain ssh and tools built on it can reach the instances
+// with their own key and pinned host key
+func (c *Client) WriteConfig() error {
+	instances, err := c.kvmClient.ListMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, configHeader, c.ConfigPath())
+	for _, metadata := range instances {
+		c.writeHostBlock(&buf, metadata)
+	}
+
+	// Replace the file in one go so ssh never reads half of it
+	partPath := c.ConfigPath() + ".part"
+	if err := os.WriteFile(partPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(partPath, c.ConfigPath()); err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) writeHostBlock(buf *bytes.Buffer, metadata *kvm.InstanceMetadata) {
+	alias := HostAlias(metadata.Name)
+
+	fmt.Fprintf(buf, "Host %s\n", alias)
+	if host, port, err := c.instanceAddress(metadata); err == nil && port != 0 {
+		fmt.Fprintf(buf, "  HostName %s\n", host)
+		fmt.Fprintf(buf, "  Port %d\n", port)
+	} else {
+		// Bridged instances only have an address once they are up
+		fmt.Fprintf(buf, "  # Address not known, the instance is %s\n", strings.ToLower(metadata.State))
+	}
+	if user := c.loginUser(metadata); user != "" {
+		fmt.Fprintf(buf, "  User %s\n", user)
+	}
+	fmt.Fprintf(buf, "  IdentityFile %s\n", configQuote(c.identityFile(metadata.Name)))
+	fmt.Fprintf(buf, "  IdentitiesOnly yes\n")
+	fmt.Fprintf(buf, "  HostKeyAlias %s\n", alias)
+	fmt.Fprintf(buf, "  UserKnownHostsFile %s\n", configQuote(c.KnownHostsPath()))
+	// Pin the host key on first use, like slackpass itself does
+	fmt.Fprintf(buf, "  StrictHostKeyChecking accept-new\n")
+	fmt.Fprintln(buf)
+}
+
+// configQuote quotes a path for an OpenSSH config file if it needs it
+func configQuote(s string) string {
+	if strings.ContainsAny(s, " \t\"") {
+		return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+	}
+	return s
+}
@@ -0,0 +1,261 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// rsaKeyBits is the size of generated RSA keys
+const rsaKeyBits = 4096
+
+// addKeyScript authorizes the key given as $2 for every user that has the
+// key given as $1. A missing newline at the end of the file is added
+// first, so the key does not end up on the same line as the last one.
+const addKeyScript = `for f in /root/.ssh/authorized_keys /home/*/.ssh/authorized_keys; do
+  sudo grep -qF "$1" "$f" 2>/dev/null || continue
+  sudo grep -qF "$2" "$f" && continue
+  if [ -n "$(sudo tail -c1 "$f")" ]; then
+    echo | sudo tee -a "$f" >/dev/null || exit 1
+  fi
+  echo "$2" | sudo tee -a "$f" >/dev/null || exit 1
+done`
+
+// removeKeyScript removes the key given as $1 from every user. The file
+// is rewritten in place so its owner and permissions are kept.
+const removeKeyScript = `for f in /root/.ssh/authorized_keys /home/*/.ssh/authorized_keys; do
+  sudo grep -qF "$1" "$f" 2>/dev/null || continue
+  tmp=$(mktemp) || exit 1
+  { sudo grep -vF "$1" "$f" || true; } > "$tmp" && sudo tee "$f" < "$tmp" >/dev/null
+  status=$?
+  rm -f "$tmp"
+  [ $status -eq 0 ] || exit 1
+done`
+
+// GenerateSSHKey writes a new keypair of the configured ssh_key_type to
+// path, readable only by the user, with the public key next to it in
+// path.pub. An existing key is kept.
+func (c *Client) GenerateSSHKey(path, comment string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	var private crypto.PrivateKey
+	switch c.config.SSHKeyType {
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("failed to generate key: %w", err)
+		}
+		private = key
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return fmt.Errorf("failed to generate key: %w", err)
+		}
+		private = key
+	default:
+		return fmt.Errorf("unsupported key type: %s", c.config.SSHKeyType)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeKeyPair(path, private, comment)
+}
+
+// GenerateInstanceKey creates the keypair slackpass logs in to an
+// instance with, unless it already exists, and returns the public key in
+// authorized_keys format
+func (c *Client) GenerateInstanceKey(name string) (string, error) {
+	keyPath := c.kvmClient.KeyPath(name)
+	if err := c.GenerateSSHKey(keyPath, "slackpass@"+name); err != nil {
+		return "", err
+	}
+	return readPublicKey(keyPath)
+}
+
+// GenerateCloneKey gives a new clone a key of its own. The guest of the
+// clone still trusts the key of its source, which it stops doing on its
+// first boot.
+func (c *Client) GenerateCloneKey(source, name string) error {
+	oldSigner, err := c.signer(source)
+	if err != nil {
+		return err
+	}
+
+	newKey, err := c.GenerateInstanceKey(name)
+	if err != nil {
+		return err
+	}
+	return c.kvmClient.RekeyClone(name, authorizedKey(oldSigner.PublicKey()), newKey)
+}
+
+// RotateKey replaces the key of a running instance. The new key is
+// authorized in the guest and tried before the old one is removed, so
+// the instance stays reachable if anything fails along the way. Instances
+// still using the global key get a key of their own.
+func (c *Client) RotateKey(name string) error {
+	metadata, err := c.runningInstance(name)
+	if err != nil {
+		return err
+	}
+	host, port, err := c.instanceAddress(metadata)
+	if err != nil {
+		return err
+	}
+
+	oldSigner, err := c.signer(name)
+	if err != nil {
+		return err
+	}
+	oldKey := authorizedKey(oldSigner.PublicKey())
+
+	oldPath := c.kvmClient.KeyPath(name)
+	keyPath := filepath.Join(filepath.Dir(oldPath), "id_"+c.config.SSHKeyType)
+	partPath := keyPath + ".part"
+	os.Remove(partPath)
+	if err := c.GenerateSSHKey(partPath, "slackpass@"+name); err != nil {
+		return err
+	}
+	defer os.Remove(partPath)
+	defer os.Remove(partPath + ".pub")
+
+	newKey, err := readPublicKey(partPath)
+	if err != nil {
+		return err
+	}
+	newSigner, err := loadSigner(partPath)
+	if err != nil {
+		return err
+	}
+
+	user := c.loginUser(metadata)
+	client, err := c.createSSHClient(name, host, port, user, oldSigner)
+	if err != nil {
+		return fmt.Errorf("failed to connect with the current key: %w", err)
+	}
+	err = runScript(client, addKeyScript, oldKey, newKey)
+	client.Close()
+	if err != nil {
+		return fmt.Errorf("failed to authorize the new key: %w", err)
+	}
+
+	client, err = c.createSSHClient(name, host, port, user, newSigner)
+	if err != nil {
+		return fmt.Errorf("failed to connect with the new key: %w", err)
+	}
+	defer client.Close()
+
+	// Keep the seed in step first, the guest accepts both keys for now
+	if err := c.kvmClient.ReplaceSSHKey(name, oldKey, newKey); err != nil {
+		return err
+	}
+
+	if err := os.Rename(partPath+".pub", keyPath+".pub"); err != nil {
+		return err
+	}
+	if err := os.Rename(partPath, keyPath); err != nil {
+		return err
+	}
+	if oldPath != keyPath {
+		// The key type changed, or the instance had no key of its own
+		os.Remove(oldPath)
+		os.Remove(oldPath + ".pub")
+	}
+
+	if err := runScript(client, removeKeyScript, oldKey); err != nil {
+		return fmt.Errorf("failed to remove the old key: %w", err)
+	}
+	return nil
+}
+
+// signer returns the key to log in to an instance with
+func (c *Client) signer(name string) (ssh.Signer, error) {
+	return loadSigner(c.identityFile(name))
+}
+
+// identityFile returns the path of the key to log in to an instance with:
+// its own key, or the global slackpass key for instances created before
+// they had one
+func (c *Client) identityFile(name string) string {
+	keyPath := c.kvmClient.KeyPath(name)
+	if _, err := os.Stat(keyPath); err != nil {
+		return c.config.SSHKeyPath
+	}
+	return keyPath
+}
+
+// runScript runs a shell script with the given arguments on an open
+// connection
+func runScript(client *ssh.Client, script string, args ...string) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create SSH session: %w", err)
+	}
+	defer session.Close()
+
+	command := buildCommand(append([]string{"sh", "-c", script, "sh"}, args...), &ExecOptions{})
+	if output, err := session.CombinedOutput(command); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func loadSigner(path string) (ssh.Signer, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH key: %w", err)
+	}
+	return signer, nil
+}
+
+func readPublicKey(keyPath string) (string, error) {
+	data, err := os.ReadFile(keyPath + ".pub")
+	if err != nil {
+		return "", fmt.Errorf("failed to read public key: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// authorizedKey returns the type and key material of a public key as it
+// appears in authorized_keys, without a comment
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// writeKeyPair writes a private key in OpenSSH format to path, readable
+// only by the user, and its public key to path.pub
+func writeKeyPair(path string, private crypto.PrivateKey, comment string) error {
+	block, err := ssh.MarshalPrivateKey(private, comment)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return err
+	}
+	public := authorizedKey(signer.PublicKey()) + " " + comment + "\n"
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return fmt.Errorf("failed to write private key: %w", err)
+	}
+	if err := os.WriteFile(path+".pub", []byte(public), 0644); err != nil {
+		return fmt.Errorf("failed to write public key: %w", err)
+	}
+	return nil
+}
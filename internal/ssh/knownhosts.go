@@ -0,0 +1,136 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// errHostKeyChanged is returned when an instance presents another host key
+// than the one pinned for it
+var errHostKeyChanged = errors.New("host key has changed")
+
+// HostAlias returns the name an instance's host key is recorded under.
+// Using an alias rather than the address keeps the key pinned when the
+// forwarded port or the bridged address changes.
+func HostAlias(name string) string {
+	return "slackpass-" + name
+}
+
+// KnownHostsPath returns the known_hosts file slackpass pins host keys in
+func (c *Client) KnownHostsPath() string {
+	return filepath.Join(c.config.DataDir, "known_hosts")
+}
+
+// hostKeyCallback trusts the host key an instance presents on the first
+// connection, records it, and rejects any other key after that
+func (c *Client) hostKeyCallback(name string) ssh.HostKeyCallback {
+	alias := knownhosts.Normalize(HostAlias(name))
+
+	return func(_ string, remote net.Addr, key ssh.PublicKey) error {
+		path := c.KnownHostsPath()
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return err
+		}
+		f.Close()
+
+		check, err := knownhosts.New(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		err = check(alias+":22", remote, key)
+		var keyErr *knownhosts.KeyError
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+			// First connection, pin the key
+			return appendKnownHost(path, alias, key)
+		case errors.As(err, &keyErr):
+			return fmt.Errorf("%s: %w, refusing to connect; "+
+				"if the instance was rebuilt, remove %s from %s", name, errHostKeyChanged, alias, path)
+		default:
+			return err
+		}
+	}
+}
+
+// hostKeyAlgorithms returns the types of the keys pinned for an instance,
+// so the server presents a key that can be checked rather than one of
+// another type
+func (c *Client) hostKeyAlgorithms(name string) []string {
+	data, err := os.ReadFile(c.KnownHostsPath())
+	if err != nil {
+		return nil
+	}
+
+	alias := knownhosts.Normalize(HostAlias(name))
+	var algorithms []string
+	for len(data) > 0 {
+		_, hosts, key, _, rest, err := ssh.ParseKnownHosts(data)
+		if err != nil {
+			break
+		}
+		data = rest
+
+		for _, host := range hosts {
+			if host != alias {
+				continue
+			}
+			if key.Type() == ssh.KeyAlgoRSA {
+				// RSA keys are used with SHA-2 signatures by modern servers
+				algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+			}
+			algorithms = append(algorithms, key.Type())
+		}
+	}
+
+	return algorithms
+}
+
+// ForgetHostKey removes the pinned host keys of an instance
+func (c *Client) ForgetHostKey(name string) error {
+	path := c.KnownHostsPath()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	alias := knownhosts.Normalize(HostAlias(name))
+	var kept bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == alias {
+			continue
+		}
+		kept.WriteString(line + "\n")
+	}
+
+	return os.WriteFile(path, kept.Bytes(), 0600)
+}
+
+func appendKnownHost(path, alias string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{alias}, key)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,119 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/slackpass/slackpass/internal/config"
+	"golang.org/x/term"
+)
+
+const (
+	// progressThreshold is the smallest file a progress bar is shown for
+	progressThreshold = 4 << 20
+
+	progressInterval = 200 * time.Millisecond
+	progressWidth    = 30
+)
+
+// progressBar draws the progress of a file transfer on stderr
+type progressBar struct {
+	name       string
+	total      int64
+	done       int64
+	started    time.Time
+	lastRender time.Time
+}
+
+// newProgressBar returns a progress bar for a file of the given size, or
+// nil when the file is small or stderr is not a terminal
+func newProgressBar(name string, total int64) *progressBar {
+	if total < progressThreshold || !term.IsTerminal(int(os.Stderr.Fd())) {
+		return nil
+	}
+	return &progressBar{name: name, total: total, started: time.Now()}
+}
+
+func (p *progressBar) add(n int) {
+	if p == nil {
+		return
+	}
+	p.done += int64(n)
+	if time.Since(p.lastRender) >= progressInterval {
+		p.render()
+	}
+}
+
+func (p *progressBar) finish() {
+	if p == nil {
+		return
+	}
+	p.render()
+	fmt.Fprintln(os.Stderr)
+}
+
+func (p *progressBar) render() {
+	p.lastRender = time.Now()
+
+	fraction := float64(p.done) / float64(p.total)
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * progressWidth)
+
+	speed := ""
+	if elapsed := time.Since(p.started).Seconds(); elapsed > 0 {
+		speed = config.FormatSize(int64(float64(p.done)/elapsed)) + "/s"
+	}
+
+	fmt.Fprintf(os.Stderr, "\r%s [%s%s] %3.0f%% %s   ",
+		p.name,
+		strings.Repeat("=", filled),
+		strings.Repeat(" ", progressWidth-filled),
+		fraction*100,
+		speed,
+	)
+}
+
+// progressWriter counts bytes written through it
+type progressWriter struct {
+	w   io.Writer
+	bar *progressBar
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.bar.add(n)
+	return n, err
+}
+
+// progressReader counts bytes read through it. Size lets the SFTP client
+// use concurrent writes for uploads.
+type progressReader struct {
+	r    io.Reader
+	size int64
+	bar  *progressBar
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.bar.add(n)
+	return n, err
+}
+
+func (r *progressReader) Size() int64 {
+	return r.size
+}
+
+// copyWithProgress copies in to out, reporting to bar. The side that is
+// not a local file is left unwrapped so the SFTP client can read or
+// write concurrently.
+func copyWithProgress(out io.Writer, in io.Reader, size int64, bar *progressBar) (int64, error) {
+	if _, local := out.(*os.File); local {
+		return io.Copy(&progressWriter{w: out, bar: bar}, in)
+	}
+	return io.Copy(out, &progressReader{r: in, size: size, bar: bar})
+}
@@ -0,0 +1,100 @@
+package ssh
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// defaultTerm is used when $TERM is not set
+const defaultTerm = "xterm-256color"
+
+// terminal puts the local terminal into raw mode for an interactive
+// session and forwards window size changes to the remote PTY
+type terminal struct {
+	fd       int
+	oldState *term.State
+	signals  chan os.Signal
+}
+
+// requestPTY requests a PTY sized like the local terminal and switches
+// the local terminal to raw mode. It returns nil if stdin is not a
+// terminal, in which case no PTY is requested.
+func requestPTY(session *ssh.Session) (*terminal, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, nil
+	}
+
+	width, height, err := term.GetSize(fd)
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	termType := os.Getenv("TERM")
+	if termType == "" {
+		termType = defaultTerm
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(termType, height, width, modes); err != nil {
+		return nil, err
+	}
+
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &terminal{
+		fd:       fd,
+		oldState: oldState,
+		signals:  make(chan os.Signal, 1),
+	}
+
+	signal.Notify(t.signals, syscall.SIGWINCH)
+	go func() {
+		for range t.signals {
+			if width, height, err := term.GetSize(fd); err == nil {
+				session.WindowChange(height, width)
+			}
+		}
+	}()
+
+	return t, nil
+}
+
+// restore stops forwarding window changes and restores the terminal
+func (t *terminal) restore() {
+	if t == nil {
+		return
+	}
+	signal.Stop(t.signals)
+	close(t.signals)
+	term.Restore(t.fd, t.oldState)
+}
+
+// attachStdin copies stdin to the session in the background. Unlike
+// setting session.Stdin, this does not make session.Wait block until
+// stdin is closed after the remote command has already exited.
+func attachStdin(session *ssh.Session) error {
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		io.Copy(stdin, os.Stdin)
+		stdin.Close()
+	}()
+
+	return nil
+}
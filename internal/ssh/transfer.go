@@ -0,0 +1,379 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Location is a path on the host or, when Instance is set, on an instance.
+// The path "-" on the host stands for stdin or stdout.
+type Location struct {
+	Instance string
+	Path     string
+}
+
+// ParseLocation parses a transfer argument: "name:path" refers to a path
+// on an instance, anything else to a host path. Host paths that contain
+// a colon can be given as ./path.
+func ParseLocation(arg string) Location {
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return Location{Path: arg}
+	}
+	if name, p, ok := strings.Cut(arg, ":"); ok && name != "" {
+		return Location{Instance: name, Path: p}
+	}
+	return Location{Path: arg}
+}
+
+func (l Location) String() string {
+	if l.Instance == "" {
+		return l.Path
+	}
+	return l.Instance + ":" + l.Path
+}
+
+// stdio reports whether the location is stdin or stdout
+func (l Location) stdio() bool {
+	return l.Instance == "" && l.Path == "-"
+}
+
+// TransferOptions controls how Transfer copies files
+type TransferOptions struct {
+	Recursive bool // Copy directories and their contents
+}
+
+// Transfer copies files between the host and an instance over SFTP.
+// Either all sources are on one instance and the target is on the host,
+// or the other way around. Permissions and modification times are kept.
+func (c *Client) Transfer(sources []Location, target Location, opts *TransferOptions) error {
+	if opts == nil {
+		opts = &TransferOptions{}
+	}
+
+	name, upload, err := transferDirection(sources, target)
+	if err != nil {
+		return err
+	}
+
+	client, err := c.connect(name)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sftpClient, err := sftp.NewClient(client, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		return fmt.Errorf("failed to start SFTP session: %w", err)
+	}
+	defer sftpClient.Close()
+
+	t := &transfer{opts: opts}
+	src, dst := fileSystem(localFS{}), fileSystem(remoteFS{sftpClient})
+	if !upload {
+		src, dst = dst, src
+	}
+
+	// Streams are copied as a single file
+	if sources[0].stdio() {
+		return t.fromStdin(dst, dst.Clean(target.Path))
+	}
+	if target.stdio() {
+		return t.toStdout(src, src.Clean(sources[0].Path))
+	}
+
+	targetPath := dst.Clean(target.Path)
+	targetInfo, err := dst.Stat(targetPath)
+	targetIsDir := err == nil && targetInfo.IsDir()
+	if len(sources) > 1 && !targetIsDir {
+		return fmt.Errorf("target %s is not a directory", target)
+	}
+
+	for _, source := range sources {
+		sourcePath := src.Clean(source.Path)
+		destination := targetPath
+		if targetIsDir {
+			destination = dst.Join(targetPath, src.Base(sourcePath))
+		}
+
+		if err := t.copy(src, sourcePath, dst, destination); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// transferDirection checks that a transfer is between the host and a
+// single instance and returns the instance and whether files go to it
+func transferDirection(sources []Location, target Location) (string, bool, error) {
+	if len(sources) == 0 {
+		return "", false, fmt.Errorf("no source given")
+	}
+
+	name := target.Instance
+	upload := name != ""
+	for _, source := range sources {
+		if upload && source.Instance != "" {
+			return "", false, fmt.Errorf("cannot copy between instances: %s", source)
+		}
+		if !upload {
+			if source.Instance == "" {
+				return "", false, fmt.Errorf("either the sources or the target must be on an instance")
+			}
+			if name != "" && source.Instance != name {
+				return "", false, fmt.Errorf("all sources must be on the same instance")
+			}
+			name = source.Instance
+		}
+	}
+
+	for _, source := range sources {
+		if source.stdio() && len(sources) > 1 {
+			return "", false, fmt.Errorf("stdin can only be copied on its own")
+		}
+	}
+	if target.stdio() && len(sources) > 1 {
+		return "", false, fmt.Errorf("only one file can be copied to stdout")
+	}
+
+	return name, upload, nil
+}
+
+// transfer copies files and directories between two file systems
+type transfer struct {
+	opts *TransferOptions
+}
+
+// copy copies a file or, with the recursive option, a directory tree
+func (t *transfer) copy(src fileSystem, srcPath string, dst fileSystem, dstPath string) error {
+	info, err := src.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+	return t.copyEntry(src, srcPath, info, dst, dstPath)
+}
+
+// copyEntry copies what info describes, which is not followed if it is a
+// symbolic link
+func (t *transfer) copyEntry(src fileSystem, srcPath string, info os.FileInfo, dst fileSystem, dstPath string) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		return t.copySymlink(src, srcPath, dst, dstPath)
+	}
+	if !info.IsDir() {
+		return t.copyFile(src, srcPath, info, dst, dstPath)
+	}
+	if !t.opts.Recursive {
+		return fmt.Errorf("%s is a directory, use --recursive to copy it", srcPath)
+	}
+
+	if err := dst.Mkdir(dstPath, info.Mode().Perm()|0700); err != nil && !os.IsExist(err) {
+		if existing, statErr := dst.Stat(dstPath); statErr != nil || !existing.IsDir() {
+			return fmt.Errorf("failed to create %s: %w", dstPath, err)
+		}
+	}
+
+	entries, err := src.ReadDir(srcPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entryPath := src.Join(srcPath, entry.Name())
+		if entry.Mode()&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice|os.ModeIrregular) != 0 {
+			// Sockets, pipes and devices have no content to copy
+			fmt.Fprintf(os.Stderr, "Warning: skipped %s, it is not a regular file\n", entryPath)
+			continue
+		}
+		if err := t.copyEntry(src, entryPath, entry, dst, dst.Join(dstPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return preserve(dst, dstPath, info)
+}
+
+// copyFile copies a regular file and its permissions and times
+func (t *transfer) copyFile(src fileSystem, srcPath string, info os.FileInfo, dst fileSystem, dstPath string) error {
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", srcPath)
+	}
+
+	in, err := src.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := dst.Create(dstPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dstPath, err)
+	}
+
+	bar := newProgressBar(src.Base(srcPath), info.Size())
+	if _, err := copyWithProgress(out, in, info.Size(), bar); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %w", srcPath, err)
+	}
+	bar.finish()
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return preserve(dst, dstPath, info)
+}
+
+// copySymlink recreates a symbolic link found inside a copied directory.
+// The target is kept as it is, so relative links keep working within the
+// copy.
+func (t *transfer) copySymlink(src fileSystem, srcPath string, dst fileSystem, dstPath string) error {
+	target, err := src.Readlink(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to read link %s: %w", srcPath, err)
+	}
+
+	// Replace what an earlier copy left behind, but never a directory
+	if existing, err := dst.Lstat(dstPath); err == nil {
+		if existing.IsDir() {
+			return fmt.Errorf("cannot replace directory %s with a link", dstPath)
+		}
+		if err := dst.Remove(dstPath); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", dstPath, err)
+		}
+	}
+
+	if err := dst.Symlink(target, dstPath); err != nil {
+		return fmt.Errorf("failed to create link %s: %w", dstPath, err)
+	}
+	return nil
+}
+
+// fromStdin writes stdin to a file on the instance
+func (t *transfer) fromStdin(dst fileSystem, dstPath string) error {
+	out, err := dst.Create(dstPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dstPath, err)
+	}
+	if _, err := io.Copy(out, os.Stdin); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// toStdout writes a file on the instance to stdout
+func (t *transfer) toStdout(src fileSystem, srcPath string) error {
+	in, err := src.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	_, err = io.Copy(os.Stdout, in)
+	return err
+}
+
+// preserve applies the permissions and modification time of info
+func preserve(fs fileSystem, p string, info os.FileInfo) error {
+	if err := fs.Chmod(p, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", p, err)
+	}
+	if err := fs.Chtimes(p, time.Now(), info.ModTime()); err != nil {
+		return fmt.Errorf("failed to set modification time of %s: %w", p, err)
+	}
+	return nil
+}
+
+// fileSystem is the part of a file system a transfer needs, so the same
+// code copies in both directions
+type fileSystem interface {
+	Stat(p string) (os.FileInfo, error)
+	Lstat(p string) (os.FileInfo, error)
+	ReadDir(p string) ([]os.FileInfo, error)
+	Open(p string) (io.ReadCloser, error)
+	Create(p string) (io.WriteCloser, error)
+	Mkdir(p string, mode os.FileMode) error
+	Chmod(p string, mode os.FileMode) error
+	Chtimes(p string, atime, mtime time.Time) error
+	Readlink(p string) (string, error)
+	Symlink(target, p string) error
+	Remove(p string) error
+	Join(elem ...string) string
+	Base(p string) string
+	Clean(p string) string
+}
+
+// localFS is the host file system
+type localFS struct{}
+
+func (localFS) Stat(p string) (os.FileInfo, error)      { return os.Stat(p) }
+func (localFS) Lstat(p string) (os.FileInfo, error)     { return os.Lstat(p) }
+func (localFS) Open(p string) (io.ReadCloser, error)    { return os.Open(p) }
+func (localFS) Create(p string) (io.WriteCloser, error) { return os.Create(p) }
+func (localFS) Mkdir(p string, mode os.FileMode) error  { return os.Mkdir(p, mode) }
+func (localFS) Chmod(p string, mode os.FileMode) error  { return os.Chmod(p, mode) }
+func (localFS) Readlink(p string) (string, error)       { return os.Readlink(p) }
+func (localFS) Symlink(target, p string) error          { return os.Symlink(target, p) }
+func (localFS) Remove(p string) error                   { return os.Remove(p) }
+func (localFS) Join(elem ...string) string              { return filepath.Join(elem...) }
+func (localFS) Base(p string) string                    { return filepath.Base(p) }
+func (localFS) Clean(p string) string                   { return filepath.Clean(p) }
+
+func (localFS) Chtimes(p string, atime, mtime time.Time) error {
+	return os.Chtimes(p, atime, mtime)
+}
+
+func (localFS) ReadDir(p string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// remoteFS is the file system of an instance, reached over SFTP
+type remoteFS struct {
+	client *sftp.Client
+}
+
+func (fs remoteFS) Stat(p string) (os.FileInfo, error)      { return fs.client.Stat(p) }
+func (fs remoteFS) Lstat(p string) (os.FileInfo, error)     { return fs.client.Lstat(p) }
+func (fs remoteFS) ReadDir(p string) ([]os.FileInfo, error) { return fs.client.ReadDir(p) }
+func (fs remoteFS) Open(p string) (io.ReadCloser, error)    { return fs.client.Open(p) }
+func (fs remoteFS) Mkdir(p string, mode os.FileMode) error  { return fs.client.Mkdir(p) }
+func (fs remoteFS) Chmod(p string, mode os.FileMode) error  { return fs.client.Chmod(p, mode) }
+func (fs remoteFS) Readlink(p string) (string, error)       { return fs.client.ReadLink(p) }
+func (fs remoteFS) Symlink(target, p string) error          { return fs.client.Symlink(target, p) }
+func (fs remoteFS) Remove(p string) error                   { return fs.client.Remove(p) }
+func (fs remoteFS) Join(elem ...string) string              { return path.Join(elem...) }
+func (fs remoteFS) Base(p string) string                    { return path.Base(p) }
+
+// Clean maps a path on an instance to one the SFTP server accepts.
+// Relative paths and ~ refer to the home directory of the login user.
+func (fs remoteFS) Clean(p string) string {
+	if p == "" || p == "~" {
+		return "."
+	}
+	return path.Clean(strings.TrimPrefix(p, "~/"))
+}
+
+func (fs remoteFS) Create(p string) (io.WriteCloser, error) {
+	return fs.client.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+}
+
+func (fs remoteFS) Chtimes(p string, atime, mtime time.Time) error {
+	return fs.client.Chtimes(p, atime, mtime)
+}
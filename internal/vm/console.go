@@ -0,0 +1,134 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// consoleEscape detaches from a console, it is Ctrl-]
+const consoleEscape = 0x1d
+
+// logPollInterval is how often a followed console log is checked for
+// new output
+const logPollInterval = 250 * time.Millisecond
+
+// Console attaches the terminal to the serial console of a running
+// instance until Ctrl-] is pressed or stdin is closed
+func (m *Manager) Console(name string) error {
+	conn, err := m.kvmClient.ConnectConsole(name)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	fmt.Printf("Connected to the console of %s, press Ctrl-] to detach\n", name)
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		oldState, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer term.Restore(fd, oldState)
+	}
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(os.Stdout, conn)
+		if err == nil {
+			err = fmt.Errorf("console of '%s' closed", name)
+		}
+		done <- err
+	}()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if i := bytes.IndexByte(buf[:n], consoleEscape); i >= 0 {
+				conn.Write(buf[:i])
+				done <- nil
+				return
+			}
+			if n > 0 {
+				if _, err := conn.Write(buf[:n]); err != nil {
+					done <- err
+					return
+				}
+			}
+			if err != nil {
+				// stdin was closed, e.g. at the end of piped input
+				done <- nil
+				return
+			}
+		}
+	}()
+
+	err = <-done
+	// In raw mode the terminal does not return the cursor by itself
+	fmt.Print("\r\n")
+	return err
+}
+
+// Logs writes the serial console log of the last boot of an instance to
+// w. With follow it keeps writing new output as it arrives, continuing
+// with the new log when the instance is restarted, until it fails.
+func (m *Manager) Logs(name string, follow bool, w io.Writer) error {
+	if !m.instanceExists(name) {
+		return fmt.Errorf("instance '%s' does not exist", name)
+	}
+
+	logPath := m.kvmClient.ConsoleLogPath(name)
+	f, err := os.Open(logPath)
+	if os.IsNotExist(err) && follow {
+		f, err = waitForFile(logPath)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+
+	for {
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+		if !follow {
+			return nil
+		}
+		time.Sleep(logPollInterval)
+
+		// A restart moves the log aside and QEMU starts a new one
+		current, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		latest, err := os.Stat(logPath)
+		if err != nil || os.SameFile(current, latest) {
+			continue
+		}
+
+		// Drain what was written to the old log before it was replaced
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+		f.Close()
+		if f, err = os.Open(logPath); err != nil {
+			return err
+		}
+	}
+}
+
+// waitForFile opens the file at path as soon as it exists
+func waitForFile(path string) (*os.File, error) {
+	for {
+		f, err := os.Open(path)
+		if !os.IsNotExist(err) {
+			return f, err
+		}
+		time.Sleep(logPollInterval)
+	}
+}
@@ -1,30 +1,42 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/slackpass/slackpass/internal/config"
+	"github.com/slackpass/slackpass/internal/images"
 	"github.com/slackpass/slackpass/internal/kvm"
 	"github.com/slackpass/slackpass/internal/ssh"
 )
 
 // Manager handles virtual machine operations
 type Manager struct {
-	config    *config.Config
-	kvmClient *kvm.Client
-	sshClient *ssh.Client
+	config       *config.Config
+	kvmClient    *kvm.Client
+	sshClient    *ssh.Client
+	imageManager *images.Manager
 }
 
-// NewManager creates a new VM manager
-func NewManager() *Manager {
-	cfg := config.Load()
-	return &Manager{
-		config:    cfg,
-		kvmClient: kvm.NewClient(cfg),
-		sshClient: ssh.NewClient(cfg),
+// NewManager creates a new VM manager from the loaded configuration
+func NewManager() (*Manager, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
+
+	return &Manager{
+		config:       cfg,
+		kvmClient:    kvm.NewClient(cfg),
+		sshClient:    ssh.NewClient(cfg),
+		imageManager: images.NewManager(cfg),
+	}, nil
 }
 
 // Launch creates and starts a new virtual machine
@@ -34,33 +46,93 @@ func (m *Manager) Launch(config *LaunchConfig) error {
 		config.Name = generateInstanceName()
 	}
 
+	// Fill in launch defaults from the configuration
+	if config.CPUs == 0 {
+		config.CPUs = m.config.DefaultCPUs
+	}
+	if config.Memory == "" {
+		config.Memory = m.config.DefaultMemory
+	}
+	if config.Disk == "" {
+		config.Disk = m.config.DefaultDisk
+	}
+	if err := checkSizes(config.Memory, config.Disk); err != nil {
+		return err
+	}
+	// The memory size is recorded the way QEMU reads it
+	memory, err := kvm.NormalizeMemory(config.Memory)
+	if err != nil {
+		return err
+	}
+	config.Memory = memory
+
+	network, err := m.networkInterface(config.Network)
+	if err != nil {
+		return err
+	}
+
+	forwards, err := m.parseForwards(config.Name, config.Forwards)
+	if err != nil {
+		return err
+	}
+	if network != nil && len(forwards) > 0 {
+		return fmt.Errorf("port forwards need user-mode networking, bridged instances are reachable directly")
+	}
+
+	mounts, err := m.parseMounts(config.Mounts)
+	if err != nil {
+		return err
+	}
+
 	// Validate that instance doesn't already exist
+	if err := kvm.ValidateName(config.Name); err != nil {
+		return err
+	}
 	if m.instanceExists(config.Name) {
 		return fmt.Errorf("instance '%s' already exists", config.Name)
 	}
 
+	// Resolve the image before anything is created
+	image, err := m.imageManager.Resolve(config.Image)
+	if err != nil {
+		return err
+	}
+
 	fmt.Printf("Launching %s...\n", config.Name)
 
+	// Download or prepare image
+	imagePath, err := m.prepareImage(image)
+	if err != nil {
+		return fmt.Errorf("failed to prepare image: %w", err)
+	}
+
 	// Create instance directory
 	instanceDir := filepath.Join(m.config.InstancesDir, config.Name)
 	if err := os.MkdirAll(instanceDir, 0755); err != nil {
 		return fmt.Errorf("failed to create instance directory: %w", err)
 	}
 
-	// Download or prepare image
-	imagePath, err := m.prepareImage(config.Image, instanceDir)
+	// Each instance only trusts its own key
+	publicKey, err := m.sshClient.GenerateInstanceKey(config.Name)
 	if err != nil {
-		return fmt.Errorf("failed to prepare image: %w", err)
+		return fmt.Errorf("failed to generate SSH key: %w", err)
 	}
 
 	// Create VM configuration
 	vmConfig := &kvm.VMConfig{
-		Name:      config.Name,
-		ImagePath: imagePath,
-		CPUs:      config.CPUs,
-		Memory:    config.Memory,
-		Disk:      config.Disk,
-		CloudInit: config.CloudInit,
+		Name:        config.Name,
+		Image:       image.Distribution + ":" + image.Version,
+		ImagePath:   imagePath,
+		CPUs:        config.CPUs,
+		Memory:      config.Memory,
+		Disk:        config.Disk,
+		User:        loginUser(config.User, m.config.SSHUser, image.DefaultUser),
+		DefaultUser: image.DefaultUser,
+		CloudInit:   config.CloudInit,
+		SSHKeys:     []string{publicKey},
+		Network:     network,
+		Forwards:    forwards,
+		Mounts:      mounts,
 	}
 
 	// Create and start the VM
@@ -72,10 +144,20 @@ func (m *Manager) Launch(config *LaunchConfig) error {
 		return fmt.Errorf("failed to start VM: %w", err)
 	}
 
-	// Wait for SSH to be available
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = time.Duration(m.config.SSHTimeout) * time.Second
+	}
+
 	fmt.Printf("Waiting for %s to be ready...\n", config.Name)
-	if err := m.sshClient.WaitForConnection(config.Name); err != nil {
-		return fmt.Errorf("failed to establish SSH connection: %w", err)
+	if err := m.waitForInstance(config.Name, timeout); err != nil {
+		return err
+	}
+	// Only now is the address of a bridged instance known
+	m.refreshSSHConfig()
+
+	if err := m.applyMounts(config.Name); err != nil {
+		return err
 	}
 
 	fmt.Printf("Launched: %s\n", config.Name)
@@ -117,13 +199,58 @@ func (m *Manager) Shell(name string) error {
 }
 
 // Exec executes a command on the specified instance
-func (m *Manager) Exec(name, command string) error {
-	return m.sshClient.Exec(name, command)
+func (m *Manager) Exec(name string, args []string, opts *ssh.ExecOptions) error {
+	return m.sshClient.Exec(name, args, opts)
+}
+
+// RotateKey replaces the SSH key of a running instance
+func (m *Manager) RotateKey(name string) error {
+	if err := m.sshClient.RotateKey(name); err != nil {
+		return err
+	}
+	m.refreshSSHConfig()
+	return nil
+}
+
+// WriteSSHConfig writes the OpenSSH config file for all instances and
+// returns its path
+func (m *Manager) WriteSSHConfig() (string, error) {
+	return m.sshClient.ConfigPath(), m.sshClient.WriteConfig()
+}
+
+// Transfer copies files between the host and an instance. Sources and
+// target are host paths or name:path, with "-" for stdin or stdout.
+func (m *Manager) Transfer(sources []string, target string, recursive bool) error {
+	locations := make([]ssh.Location, 0, len(sources))
+	for _, source := range sources {
+		locations = append(locations, ssh.ParseLocation(source))
+	}
+
+	return m.sshClient.Transfer(locations, ssh.ParseLocation(target), &ssh.TransferOptions{
+		Recursive: recursive,
+	})
 }
 
-// Start starts the specified instance
+// Start starts the specified instance and mounts its shared directories.
+// A bridged instance is waited for, so its address can be written to the
+// OpenSSH config.
 func (m *Manager) Start(name string) error {
-	return m.kvmClient.Start(name)
+	if err := m.kvmClient.Start(name); err != nil {
+		return err
+	}
+
+	metadata, err := m.kvmClient.Metadata(name)
+	if err != nil {
+		return err
+	}
+	if metadata.Network == kvm.NetworkBridge {
+		if err := m.waitForInstance(name, time.Duration(m.config.SSHTimeout)*time.Second); err != nil {
+			return err
+		}
+	}
+	m.refreshSSHConfig()
+
+	return m.applyMounts(name)
 }
 
 // Stop stops the specified instance
@@ -131,9 +258,105 @@ func (m *Manager) Stop(name string, force bool) error {
 	return m.kvmClient.Stop(name, force)
 }
 
+// Suspend suspends the specified instance
+func (m *Manager) Suspend(name string) error {
+	return m.kvmClient.Suspend(name)
+}
+
+// Resume resumes the specified suspended instance
+func (m *Manager) Resume(name string) error {
+	if err := m.kvmClient.Resume(name); err != nil {
+		return err
+	}
+	m.refreshSSHConfig()
+	return nil
+}
+
+// Clone copies the source instance to a new stopped instance. Without a
+// name the clone is called "<source>-cloneN".
+func (m *Manager) Clone(source, name string) (string, error) {
+	if name == "" {
+		for i := 1; ; i++ {
+			name = fmt.Sprintf("%s-clone%d", source, i)
+			if !m.instanceExists(name) {
+				break
+			}
+		}
+	}
+
+	if _, err := m.kvmClient.Clone(source, name); err != nil {
+		return "", err
+	}
+	if err := m.sshClient.GenerateCloneKey(source, name); err != nil {
+		m.kvmClient.Delete(name, true, true)
+		return "", fmt.Errorf("failed to give the clone a key: %w", err)
+	}
+	m.refreshSSHConfig()
+	return name, nil
+}
+
+// Export writes the specified instance to an archive at path
+func (m *Manager) Export(name, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := m.kvmClient.Export(name, f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// Import restores an instance from the archive at path. Without a name
+// the instance keeps the name it was exported under.
+func (m *Manager) Import(path, name string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	metadata, err := m.kvmClient.Import(f, name)
+	if err != nil {
+		return "", err
+	}
+	m.refreshSSHConfig()
+	return metadata.Name, nil
+}
+
+// Forwards returns the port forwards of the specified instance
+func (m *Manager) Forwards(name string) ([]kvm.PortForward, error) {
+	return m.kvmClient.Forwards(name)
+}
+
+// AddForward adds a port forward, e.g. "8080:80", to the specified instance
+func (m *Manager) AddForward(name, spec string) error {
+	forward, err := kvm.ParsePortForward(spec)
+	if err != nil {
+		return err
+	}
+	return m.kvmClient.AddForward(name, forward)
+}
+
+// RemoveForward removes the forward of a host port from the specified
+// instance
+func (m *Manager) RemoveForward(name, hostPort string) error {
+	return m.kvmClient.RemoveForward(name, hostPort)
+}
+
 // Delete deletes the specified instance
 func (m *Manager) Delete(name string, purge, force bool) error {
-	return m.kvmClient.Delete(name, purge, force)
+	if err := m.kvmClient.Delete(name, purge, force); err != nil {
+		return err
+	}
+
+	m.refreshSSHConfig()
+
+	// A new instance with the same name will have a different host key
+	return m.sshClient.ForgetHostKey(name)
 }
 
 // Info displays detailed information about the specified instance
@@ -141,28 +364,152 @@ func (m *Manager) Info(name string) error {
 	return m.kvmClient.Info(name)
 }
 
+// Snapshot takes a named snapshot of the specified instance
+func (m *Manager) Snapshot(name, snapshot, comment string) (*kvm.Snapshot, error) {
+	return m.kvmClient.Snapshot(name, snapshot, comment)
+}
+
+// Restore reverts the specified instance to a snapshot
+func (m *Manager) Restore(name, snapshot string) error {
+	return m.kvmClient.Restore(name, snapshot)
+}
+
+// Snapshots returns the snapshots of the specified instance
+func (m *Manager) Snapshots(name string) ([]*kvm.Snapshot, error) {
+	return m.kvmClient.Snapshots(name)
+}
+
+// DeleteSnapshot removes a snapshot of the specified instance
+func (m *Manager) DeleteSnapshot(name, snapshot string) error {
+	return m.kvmClient.DeleteSnapshot(name, snapshot)
+}
+
 // Helper functions
 
+// consoleTailLines is how much of the console log is shown when an
+// instance does not become ready
+const consoleTailLines = 20
+
+// waitForInstance waits until an instance can be logged in to and has
+// finished cloud-init. If it does not get there in time, the end of its
+// console log is shown to help find out why.
+func (m *Manager) waitForInstance(name string, timeout time.Duration) error {
+	err := m.sshClient.WaitForConnection(name, timeout)
+	if errors.Is(err, ssh.ErrNotReady) {
+		if lines, tailErr := m.kvmClient.ConsoleTail(name, consoleTailLines); tailErr == nil && len(lines) > 0 {
+			fmt.Fprintf(os.Stderr, "Last console output of %s:\n", name)
+			for _, line := range lines {
+				fmt.Fprintf(os.Stderr, "  %s\n", line)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s is not ready: %w", name, err)
+	}
+	return nil
+}
+
+// refreshSSHConfig rewrites the OpenSSH config file after instances have
+// changed. It only matters to plain ssh, so a failure is only reported.
+func (m *Manager) refreshSSHConfig() {
+	if err := m.sshClient.WriteConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to update %s: %v\n", m.sshClient.ConfigPath(), err)
+	}
+}
+
 func (m *Manager) instanceExists(name string) bool {
 	instanceDir := filepath.Join(m.config.InstancesDir, name)
 	_, err := os.Stat(instanceDir)
 	return err == nil
 }
 
-func (m *Manager) prepareImage(image, instanceDir string) (string, error) {
-	// This will be implemented to download/prepare cloud images
-	// For now, return a placeholder path
-	imagePath := filepath.Join(instanceDir, "disk.qcow2")
-	return imagePath, nil
+// parseForwards parses the port forwards given at launch and checks them
+// against the forwards of other instances
+func (m *Manager) parseForwards(name string, specs []string) ([]kvm.PortForward, error) {
+	forwards := make([]kvm.PortForward, 0, len(specs))
+	for _, spec := range specs {
+		forward, err := kvm.ParsePortForward(spec)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, forward)
+	}
+
+	if err := m.kvmClient.ValidateForwards(name, forwards); err != nil {
+		return nil, err
+	}
+	return forwards, nil
+}
+
+// networkInterface turns the launch network configuration into the
+// interface the instance is created with
+func (m *Manager) networkInterface(network *NetworkConfig) (*kvm.NetworkInterface, error) {
+	if network == nil {
+		return nil, nil
+	}
+	if network.IPAddress != "" {
+		return nil, fmt.Errorf("static IP addresses are not supported, the guest uses DHCP")
+	}
+
+	bridge := network.Bridge
+	if bridge == "" {
+		bridge = m.config.BridgeName
+	}
+
+	return &kvm.NetworkInterface{
+		Name:   "net0",
+		Type:   kvm.NetworkBridge,
+		Bridge: bridge,
+		MAC:    network.MAC,
+	}, nil
+}
+
+// loginUser picks the user an instance is logged in to as: the one given
+// at launch, then the configured ssh_user, then the image's default user
+func loginUser(users ...string) string {
+	for _, user := range users {
+		if user != "" {
+			return user
+		}
+	}
+	return ""
+}
+
+// checkSizes validates the memory and disk sizes of a launch
+func checkSizes(memory, disk string) error {
+	if _, err := config.ParseSize(memory); err != nil {
+		return fmt.Errorf("invalid memory size: %w", err)
+	}
+	if _, err := config.ParseSize(disk); err != nil {
+		return fmt.Errorf("invalid disk size: %w", err)
+	}
+	return nil
+}
+
+// prepareImage returns the path of the cached base image, downloading it
+// first if needed
+func (m *Manager) prepareImage(image *images.ImageInfo) (string, error) {
+	name := image.Distribution + ":" + image.Version
+
+	downloading := false
+	imagePath, err := m.imageManager.Download(name, func(p *images.DownloadProgress) {
+		downloading = true
+		fmt.Printf("\rDownloading %s: %5.1f%% (%s, %s remaining)   ", p.ImageName, p.Percentage, p.Speed, p.TimeRemaining)
+	})
+	if downloading {
+		fmt.Println()
+	}
+
+	return imagePath, err
 }
 
 func generateInstanceName() string {
 	// Generate a random name like "keen-butterfly"
 	adjectives := []string{"keen", "bold", "swift", "bright", "calm", "eager"}
 	animals := []string{"butterfly", "dolphin", "eagle", "fox", "hawk", "lion"}
-	
+
 	adj := adjectives[len(adjectives)%6]
 	animal := animals[len(animals)%6]
-	
+
 	return fmt.Sprintf("%s-%s", adj, animal)
-}
\ No newline at end of file
+}
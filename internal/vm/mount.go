@@ -0,0 +1,153 @@
+package vm
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/slackpass/slackpass/internal/kvm"
+)
+
+// ninePOptions are the mount options for 9p shares in the guest
+const ninePOptions = "trans=virtio,version=9p2000.L,msize=524288"
+
+// Mount shares a host directory with the specified instance at target,
+// which defaults to the same path as on the host. A running instance has
+// the directory mounted right away, a stopped one on its next start.
+func (m *Manager) Mount(source, name, target string) error {
+	mount, err := m.kvmClient.NewMount(source, target)
+	if err != nil {
+		return err
+	}
+
+	added, err := m.kvmClient.AddMount(name, mount)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := m.kvmClient.Metadata(name)
+	if err != nil {
+		return err
+	}
+	if metadata.State != string(kvm.StateRunning) {
+		return nil
+	}
+
+	if err := m.mountInGuest(name, added); err != nil {
+		m.kvmClient.RemoveMount(name, added.Target)
+		return err
+	}
+	return nil
+}
+
+// Umount stops sharing the directory mounted at target with the specified
+// instance. An empty target removes all mounts.
+func (m *Manager) Umount(name, target string) error {
+	metadata, err := m.kvmClient.Metadata(name)
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	mounts := metadata.Mounts
+	if target != "" {
+		mounts = nil
+		for _, mount := range metadata.Mounts {
+			if mount.Target == filepath.Clean(target) {
+				mounts = append(mounts, mount)
+			}
+		}
+		if len(mounts) == 0 {
+			return fmt.Errorf("nothing is mounted on %s in '%s'", target, name)
+		}
+	}
+
+	for _, mount := range mounts {
+		if metadata.State == string(kvm.StateRunning) {
+			if err := m.umountInGuest(name, &mount); err != nil {
+				return err
+			}
+		}
+		if err := m.kvmClient.RemoveMount(name, mount.Target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Mounts returns the directories shared with the specified instance
+func (m *Manager) Mounts(name string) ([]kvm.Mount, error) {
+	return m.kvmClient.Mounts(name)
+}
+
+// applyMounts mounts every share of a running instance in the guest that
+// is not mounted yet
+func (m *Manager) applyMounts(name string) error {
+	mounts, err := m.kvmClient.Mounts(name)
+	if err != nil {
+		return err
+	}
+	if len(mounts) == 0 {
+		return nil
+	}
+
+	if err := m.waitForInstance(name, time.Duration(m.config.SSHTimeout)*time.Second); err != nil {
+		return err
+	}
+
+	for i := range mounts {
+		if err := m.mountInGuest(name, &mounts[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountInGuest mounts a share over SSH unless it is already mounted
+func (m *Manager) mountInGuest(name string, mount *kvm.Mount) error {
+	if _, err := m.sshClient.Run(name, []string{"mountpoint", "-q", mount.Target}); err == nil {
+		return nil
+	}
+
+	if _, err := m.sshClient.Run(name, []string{"sudo", "mkdir", "-p", mount.Target}); err != nil {
+		return fmt.Errorf("failed to create %s in the guest: %w", mount.Target, err)
+	}
+
+	args := []string{"sudo", "mount", "-t", mount.Type}
+	if mount.Type == kvm.Mount9p {
+		args = append(args, "-o", ninePOptions)
+	}
+	args = append(args, mount.Tag, mount.Target)
+
+	if _, err := m.sshClient.Run(name, args); err != nil {
+		return fmt.Errorf("failed to mount %s in the guest: %w", mount.Target, err)
+	}
+	return nil
+}
+
+// umountInGuest unmounts a share over SSH if it is mounted
+func (m *Manager) umountInGuest(name string, mount *kvm.Mount) error {
+	if _, err := m.sshClient.Run(name, []string{"mountpoint", "-q", mount.Target}); err != nil {
+		return nil
+	}
+
+	if _, err := m.sshClient.Run(name, []string{"sudo", "umount", mount.Target}); err != nil {
+		return fmt.Errorf("failed to unmount %s in the guest: %w", mount.Target, err)
+	}
+	return nil
+}
+
+// parseMounts parses the mounts given at launch as source[:target]
+func (m *Manager) parseMounts(specs []string) ([]kvm.Mount, error) {
+	mounts := make([]kvm.Mount, 0, len(specs))
+	for _, spec := range specs {
+		source, target, _ := strings.Cut(spec, ":")
+		mount, err := m.kvmClient.NewMount(source, target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mount %q: %w", spec, err)
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
@@ -1,13 +1,20 @@
 package vm
 
+import "time"
+
 // LaunchConfig contains configuration for launching a new VM
 type LaunchConfig struct {
-	Image     string // e.g., "debian:bookworm"
-	Name      string // VM instance name
-	CPUs      int    // Number of CPUs
-	Memory    string // Memory size (e.g., "2G")
-	Disk      string // Disk size (e.g., "20G")
-	CloudInit string // Path to cloud-init file
+	Image     string         // e.g., "debian:bookworm"
+	Name      string         // VM instance name
+	CPUs      int            // Number of CPUs
+	Memory    string         // Memory size (e.g., "2G")
+	Disk      string         // Disk size (e.g., "20G")
+	User      string         // Login user, defaults to the image's default user
+	CloudInit string         // Path to cloud-init file
+	Network   *NetworkConfig // Bridged networking, nil for user-mode networking
+	Forwards  []string       // Port forwards, e.g. "8080:80"
+	Mounts    []string       // Host directories to share as source[:target]
+	Timeout   time.Duration  // How long to wait for the instance, defaults to ssh_timeout
 }
 
 // ImageInfo represents information about a cloud image
@@ -22,7 +29,7 @@ type ImageInfo struct {
 
 // NetworkConfig represents network configuration for a VM
 type NetworkConfig struct {
-	Bridge    string `json:"bridge"`     // Bridge interface name
+	Bridge    string `json:"bridge"`     // Bridge interface name, defaults to bridge_name
 	IPAddress string `json:"ip_address"` // Static IP (optional)
 	MAC       string `json:"mac"`        // MAC address
-}
\ No newline at end of file
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
+	"golang.org/x/crypto/ssh"
+
 	"github.com/slackpass/slackpass/cmd"
 )
 
 func main() {
 	if err := cmd.Execute(); err != nil {
+		// Pass the exit status of remote commands through
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitStatus())
+		}
+
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}